@@ -5,35 +5,164 @@ package luajitter
 */
 import "C"
 import (
+	"errors"
+	"fmt"
 	"github.com/baohavan/go-pointer"
+	"io"
+	"reflect"
+	"runtime/debug"
 	"unsafe"
 )
 
+// GoFunction marks a go function to be pushed to lua as a real lua function instead of the usual callable
+// userdata. Lua only invokes some metamethods, such as __index and __newindex, when they are functions.
+// Func may be any function SetGlobal accepts.
+type GoFunction struct {
+	Func interface{}
+}
+
+func (f GoFunction) callback() (interface{}, error) {
+	switch callback := f.Func.(type) {
+	case func([]interface{}) ([]interface{}, error), func(*LuaState, []interface{}) ([]interface{}, error):
+		return callback, nil
+	}
+
+	reflected := reflect.ValueOf(f.Func)
+	if reflected.Kind() != reflect.Func || reflected.IsNil() {
+		return nil, errors.New("GoFunction requires a non-nil function")
+	}
+	return wrapReflectedFunction(reflected), nil
+}
+
+func lookupState(_L *C.lua_State) *LuaState {
+	state, ok := vmMap[_L]
+	if ok {
+		return state
+	}
+
+	//Callbacks made from within a coroutine receive the coroutine's thread
+	return vmMap[C.get_main_thread(_L)]
+}
+
 //export releaseCGOHandle
 func releaseCGOHandle(handle unsafe.Pointer) *C.lua_err {
 	pointer.Unref(handle)
 	return nil
 }
 
+//export goErrorMessage
+func goErrorMessage(handle unsafe.Pointer) *C.char {
+	err, ok := pointer.Restore(handle).(error)
+	if !ok {
+		return C.CString("invalid go error")
+	}
+	return C.CString(err.Error())
+}
+
+// chunkReader is the go side of a lua_load reader, it keeps the first read error so it can be reported once
+// lua_load returns
+type chunkReader struct {
+	reader io.Reader
+	err    error
+}
+
+//export readGoReader
+func readGoReader(handle unsafe.Pointer, buffer *C.char, capacity C.size_t) (read C.size_t) {
+	state := pointer.Restore(handle).(*chunkReader)
+	if state.err != nil {
+		return 0
+	}
+
+	//Panics can't unwind through lua_load, so they end the chunk and are reported once it returns
+	defer func() {
+		if r := recover(); r != nil {
+			state.err = fmt.Errorf("chunk reader panicked: %v", r)
+			read = 0
+		}
+	}()
+
+	out := (*[1 << 30]byte)(unsafe.Pointer(buffer))[:capacity:capacity]
+	for attempt := 0; attempt < 100; attempt++ {
+		n, err := state.reader.Read(out)
+		if err != nil && err != io.EOF {
+			state.err = err
+		}
+		//Lua takes an empty read as the end of the chunk
+		if n > 0 || err != nil {
+			return C.size_t(n)
+		}
+	}
+
+	state.err = io.ErrNoProgress
+	return 0
+}
+
+func callbackPanic(state *LuaState, r interface{}) *CallbackPanicError {
+	//Panics rethrown from a nested call keep their original stack
+	panicErr, isPanicErr := r.(*CallbackPanicError)
+	if !isPanicErr {
+		panicErr = &CallbackPanicError{
+			Value: r,
+			Stack: debug.Stack(),
+		}
+	}
+
+	if state != nil && state.panicMode == PanicModeRepanic && state.pendingPanic == nil {
+		state.pendingPanic = panicErr
+	}
+	return panicErr
+}
+
 //export callbackGoFunction
 func callbackGoFunction(_L *C.lua_State, handle unsafe.Pointer, args C.lua_args, ret *C.lua_return) {
-	handlePtr := pointer.Restore(handle)
-	goFunction, ok := handlePtr.(func([]interface{}) ([]interface{}, error))
-	if !ok {
+	state := lookupState(_L)
+
+	//User code runs all the way through- the callback itself, then MarshalLua and reflection over the values
+	//it returns- and a panic must not unwind through lua's C frames
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		panicErr := callbackPanic(state, r)
+		if ret.err.message != nil {
+			C.chfree(unsafe.Pointer(ret.err.message))
+		}
+		ret.err.message = C.CString(panicErr.Error())
+		C.increment_allocs()
+		ret.err.value, _ = fromGoValue(state, panicErr, nil)
+	}()
+
+	var goFunction func([]interface{}) ([]interface{}, error)
+	switch callback := pointer.Restore(handle).(type) {
+	case func([]interface{}) ([]interface{}, error):
+		goFunction = callback
+	case func(*LuaState, []interface{}) ([]interface{}, error):
+		goFunction = func(args []interface{}) ([]interface{}, error) {
+			return callback(state, args)
+		}
+	default:
 		ret.err.message = C.CString("attempted to call go function with non-callback object")
 		C.increment_allocs()
 		return
 	}
 
-	state := vmMap[_L]
 	argCount := int(args.valueCount)
 	argsList := (*[1 << 30]*C.struct_lua_value)(unsafe.Pointer(args.values))
 	goArgs := buildGoValues(state, argCount, argsList)
 
 	retVals, err := goFunction(goArgs)
+	if argErr, isArgErr := err.(*ArgumentError); isArgErr && argErr.Function == "" {
+		if name := C.get_calling_function_name(_L); name != nil {
+			argErr.Function = C.GoString(name)
+		}
+	}
 	if err != nil {
 		ret.err.message = C.CString(err.Error())
 		C.increment_allocs()
+		//Carry the error itself along so it can be recovered if it comes back out of lua
+		ret.err.value, _ = fromGoValue(state, err, nil)
 		return
 	}
 
@@ -53,7 +182,6 @@ func callbackGoFunction(_L *C.lua_State, handle unsafe.Pointer, args C.lua_args,
 		createValues++
 	}
 
-	ret.err = nil
 	ret.valueCount = C.int(len(retVals))
 	ret.values = C.build_values(_L, ret.valueCount, C.int(createValues))
 	allValues := (*[1 << 30]*C.struct_lua_value)(unsafe.Pointer(ret.values))
@@ -81,7 +209,14 @@ func callbackGoFunction(_L *C.lua_State, handle unsafe.Pointer, args C.lua_args,
 		value, err = fromGoValue(state, singleVal, allValues[idx])
 		allValues[idx] = value
 		if err != nil {
-			break
+			//The values built so far are freed along with the return once lua raises the error
+			err = fmt.Errorf("cannot return value %d to lua: %w", idx+1, err)
+			ret.err.message = C.CString(err.Error())
+			C.increment_allocs()
+			ret.err.value, _ = fromGoValue(state, err, nil)
+			return
 		}
 	}
+
+	ret.err = nil
 }
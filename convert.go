@@ -0,0 +1,181 @@
+package luajitter
+
+/*
+#include "go_luajit.h"
+*/
+import "C"
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+type DecodeError struct {
+	Path    string
+	Message string
+}
+
+func (e *DecodeError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+func mismatchError(path string, expected string, src interface{}) error {
+	return &DecodeError{Path: path, Message: fmt.Sprintf("%s expected, got %s", expected, luaTypeName(src))}
+}
+
+func luaTypeName(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "nil"
+	case float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return "number"
+	case string, []byte:
+		return "string"
+	case bool:
+		return "boolean"
+	case *LocalLuaTable, map[interface{}]interface{}, []interface{}:
+		return "table"
+	case *LocalLuaFunction:
+		return "function"
+	case *LocalLuaData:
+		if v.value == nil {
+			return "userdata"
+		}
+
+		switch v.value.valueType {
+		case C.LUA_TFUNCTION:
+			return "function"
+		case C.LUA_TTHREAD:
+			return "thread"
+		case C.LUA_TLIGHTUSERDATA, C.LUA_TUSERDATA:
+			return "userdata"
+		case C.LUA_TCDATA:
+			return "cdata"
+		}
+	}
+
+	return "userdata"
+}
+
+func isByteSlice(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8
+}
+
+func expectedTypeName(dstType reflect.Type) string {
+	if isByteSlice(dstType) {
+		return "string"
+	}
+
+	switch dstType.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Map, reflect.Struct, reflect.Slice, reflect.Array:
+		return "table"
+	case reflect.Func:
+		return "function"
+	case reflect.Ptr:
+		return expectedTypeName(dstType.Elem())
+	}
+
+	return "userdata"
+}
+
+func canBeNil(dstType reflect.Type) bool {
+	switch dstType.Kind() {
+	case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func:
+		return true
+	}
+	return false
+}
+
+func convertNumber(path string, number float64, dstType reflect.Type) (reflect.Value, error) {
+	out := reflect.New(dstType).Elem()
+
+	switch dstType.Kind() {
+	case reflect.Float32:
+		if math.Abs(number) > math.MaxFloat32 && !math.IsInf(number, 0) {
+			return out, &DecodeError{Path: path, Message: fmt.Sprintf("number %v overflows %s", number, dstType)}
+		}
+		out.SetFloat(number)
+	case reflect.Float64:
+		out.SetFloat(number)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if number != math.Trunc(number) {
+			return out, &DecodeError{Path: path, Message: fmt.Sprintf("number %v has no integer representation", number)}
+		}
+		if number < -(1<<63) || number >= (1<<63) || out.OverflowInt(int64(number)) {
+			return out, &DecodeError{Path: path, Message: fmt.Sprintf("number %v overflows %s", number, dstType)}
+		}
+		out.SetInt(int64(number))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if number != math.Trunc(number) {
+			return out, &DecodeError{Path: path, Message: fmt.Sprintf("number %v has no integer representation", number)}
+		}
+		if number < 0 || number >= (1<<64) || out.OverflowUint(uint64(number)) {
+			return out, &DecodeError{Path: path, Message: fmt.Sprintf("number %v overflows %s", number, dstType)}
+		}
+		out.SetUint(uint64(number))
+	default:
+		return out, mismatchError(path, expectedTypeName(dstType), number)
+	}
+
+	return out, nil
+}
+
+// convertInteger converts the 64-bit integers lua can hand back without going through a float64, which would lose precision
+func convertInteger(path string, src interface{}, dstType reflect.Type) (reflect.Value, error) {
+	out := reflect.New(dstType).Elem()
+
+	var signed int64
+	var unsigned uint64
+	negative := false
+	fitsSigned := true
+	switch v := src.(type) {
+	case int64:
+		signed = v
+		unsigned = uint64(v)
+		negative = v < 0
+	case uint64:
+		signed = int64(v)
+		unsigned = v
+		fitsSigned = v <= math.MaxInt64
+	}
+
+	switch dstType.Kind() {
+	case reflect.Float32, reflect.Float64:
+		if negative {
+			out.SetFloat(float64(signed))
+		} else {
+			out.SetFloat(float64(unsigned))
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !fitsSigned || out.OverflowInt(signed) {
+			return out, &DecodeError{Path: path, Message: fmt.Sprintf("number %v overflows %s", src, dstType)}
+		}
+		out.SetInt(signed)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if negative || out.OverflowUint(unsigned) {
+			return out, &DecodeError{Path: path, Message: fmt.Sprintf("number %v overflows %s", src, dstType)}
+		}
+		out.SetUint(unsigned)
+	default:
+		return out, mismatchError(path, expectedTypeName(dstType), src)
+	}
+
+	return out, nil
+}
+
+// convertValue converts a value that came out of lua into the requested go type
+func convertValue(src interface{}, dstType reflect.Type) (reflect.Value, error) {
+	d := &decoder{}
+	return d.convert("", src, dstType)
+}
@@ -0,0 +1,318 @@
+package luajitter
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+type decoder struct {
+	strict bool
+	used   map[LocalData]bool
+	marked map[uintptr]bool
+	closed map[uintptr]bool
+}
+
+// LuaUnmarshaler is implemented by types that decode themselves from lua values. The value is converted the same
+// way as Unroll, and any tables, functions or userdata in it are only valid for the duration of the call.
+type LuaUnmarshaler interface {
+	UnmarshalLua(value interface{}) error
+}
+
+var luaUnmarshalerType = reflect.TypeOf((*LuaUnmarshaler)(nil)).Elem()
+
+type DecodeOption func(*decoder)
+
+// DecodeStrict makes decoding fail when a table has keys that do not match any struct field
+func DecodeStrict() DecodeOption {
+	return func(d *decoder) {
+		d.strict = true
+	}
+}
+
+func newDecoder(options []DecodeOption) *decoder {
+	d := &decoder{}
+	for _, option := range options {
+		option(d)
+	}
+	return d
+}
+
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func indexPath(path string, index interface{}) string {
+	return fmt.Sprintf("%s[%v]", path, index)
+}
+
+// markUsed keeps local data stored in the decoded value from being closed, including everything inside an unrolled
+// table that is assigned as a whole
+func (d *decoder) markUsed(src interface{}) {
+	switch v := src.(type) {
+	case LocalData:
+		if d.used == nil {
+			d.used = make(map[LocalData]bool)
+		}
+		d.used[v] = true
+	case map[interface{}]interface{}:
+		//Unrolled tables can contain cycles
+		if d.marked == nil {
+			d.marked = make(map[uintptr]bool)
+		}
+		mapPointer := reflect.ValueOf(v).Pointer()
+		if d.marked[mapPointer] {
+			return
+		}
+		d.marked[mapPointer] = true
+
+		for key, value := range v {
+			d.markUsed(key)
+			d.markUsed(value)
+		}
+	}
+}
+
+// closeUnused releases any local data that was unrolled from a table but not stored in the decoded value
+func (d *decoder) closeUnused(src interface{}) {
+	switch v := src.(type) {
+	case LocalData:
+		if !d.used[v] {
+			v.Close()
+		}
+	case map[interface{}]interface{}:
+		//Unrolled tables can contain cycles
+		if d.closed == nil {
+			d.closed = make(map[uintptr]bool)
+		}
+		mapPointer := reflect.ValueOf(v).Pointer()
+		if d.closed[mapPointer] {
+			return
+		}
+		d.closed[mapPointer] = true
+
+		for key, value := range v {
+			d.closeUnused(key)
+			d.closeUnused(value)
+		}
+	}
+}
+
+func (d *decoder) convert(path string, src interface{}, dstType reflect.Type) (reflect.Value, error) {
+	if src == nil {
+		if !canBeNil(dstType) {
+			return reflect.Value{}, mismatchError(path, expectedTypeName(dstType), nil)
+		}
+		return reflect.Zero(dstType), nil
+	}
+
+	srcValue := reflect.ValueOf(src)
+	if srcValue.Type().AssignableTo(dstType) {
+		d.markUsed(src)
+		out := reflect.New(dstType).Elem()
+		out.Set(srcValue)
+		return out, nil
+	}
+
+	if reflect.PtrTo(dstType).Implements(luaUnmarshalerType) {
+		out := reflect.New(dstType)
+		err := out.Interface().(LuaUnmarshaler).UnmarshalLua(src)
+		if err != nil {
+			return reflect.Value{}, &DecodeError{Path: path, Message: err.Error()}
+		}
+		return out.Elem(), nil
+	}
+
+	if dstType.Kind() == reflect.Ptr {
+		elem, err := d.convert(path, src, dstType.Elem())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		out := reflect.New(dstType.Elem())
+		out.Elem().Set(elem)
+		return out, nil
+	}
+
+	switch v := src.(type) {
+	case float64:
+		return convertNumber(path, v, dstType)
+	case int64, uint64:
+		return convertInteger(path, v, dstType)
+	case string:
+		if dstType.Kind() == reflect.String || isByteSlice(dstType) {
+			return srcValue.Convert(dstType), nil
+		}
+	case []byte:
+		if dstType.Kind() == reflect.String || isByteSlice(dstType) {
+			return srcValue.Convert(dstType), nil
+		}
+	case bool:
+		if dstType.Kind() == reflect.Bool {
+			return srcValue.Convert(dstType), nil
+		}
+	case *LocalLuaTable:
+		switch dstType.Kind() {
+		case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+			unrolled, err := v.Unroll()
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			out, err := d.convert(path, unrolled, dstType)
+			d.closeUnused(unrolled)
+			return out, err
+		}
+	case map[interface{}]interface{}:
+		switch dstType.Kind() {
+		case reflect.Struct:
+			return d.convertStruct(path, v, dstType)
+		case reflect.Map:
+			return d.convertMap(path, v, dstType)
+		case reflect.Slice, reflect.Array:
+			return d.convertSequence(path, v, dstType)
+		}
+	}
+
+	return reflect.Value{}, mismatchError(path, expectedTypeName(dstType), src)
+}
+
+func (d *decoder) convertStruct(path string, src map[interface{}]interface{}, dstType reflect.Type) (reflect.Value, error) {
+	out := reflect.New(dstType).Elem()
+	fields := structFields(dstType)
+
+	for key, value := range src {
+		name, isString := key.(string)
+		var field fieldInfo
+		found := false
+		if isString {
+			field, found = findField(fields, name)
+		}
+
+		if !found {
+			if d.strict {
+				return reflect.Value{}, &DecodeError{Path: path, Message: fmt.Sprintf("unknown key '%v' for %s", key, dstType)}
+			}
+			continue
+		}
+
+		fieldValue := out.FieldByIndex(field.index)
+		converted, err := d.convert(joinPath(path, name), value, fieldValue.Type())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		fieldValue.Set(converted)
+	}
+
+	return out, nil
+}
+
+func (d *decoder) convertMap(path string, src map[interface{}]interface{}, dstType reflect.Type) (reflect.Value, error) {
+	out := reflect.MakeMapWithSize(dstType, len(src))
+
+	for key, value := range src {
+		convertedKey, err := d.convert(indexPath(path, key), key, dstType.Key())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+
+		convertedValue, err := d.convert(indexPath(path, key), value, dstType.Elem())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+
+		out.SetMapIndex(convertedKey, convertedValue)
+	}
+
+	return out, nil
+}
+
+func sequenceIndex(key interface{}, length int) (int, bool) {
+	var index int
+	switch number := key.(type) {
+	case float64:
+		if number != float64(int(number)) {
+			return 0, false
+		}
+		index = int(number)
+	case int64:
+		index = int(number)
+	default:
+		return 0, false
+	}
+
+	return index, index >= 1 && index <= length
+}
+
+func (d *decoder) convertSequence(path string, src map[interface{}]interface{}, dstType reflect.Type) (reflect.Value, error) {
+	length := len(src)
+	var out reflect.Value
+	if dstType.Kind() == reflect.Array {
+		if length > dstType.Len() {
+			return reflect.Value{}, &DecodeError{Path: path, Message: fmt.Sprintf("table with %d entries does not fit in %s", length, dstType)}
+		}
+		out = reflect.New(dstType).Elem()
+	} else {
+		out = reflect.MakeSlice(dstType, length, length)
+	}
+
+	for key, value := range src {
+		index, ok := sequenceIndex(key, length)
+		if !ok {
+			return reflect.Value{}, &DecodeError{Path: path, Message: fmt.Sprintf("table is not a sequence, found key '%v'", key)}
+		}
+
+		converted, err := d.convert(indexPath(path, index), value, dstType.Elem())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		out.Index(index - 1).Set(converted)
+	}
+
+	return out, nil
+}
+
+func decodeInto(src interface{}, out interface{}, d *decoder) error {
+	outValue := reflect.ValueOf(out)
+	if outValue.Kind() != reflect.Ptr || outValue.IsNil() {
+		return errors.New("decode target must be a non-nil pointer")
+	}
+
+	converted, err := d.convert("", src, outValue.Elem().Type())
+	if err != nil {
+		return err
+	}
+	outValue.Elem().Set(converted)
+	return nil
+}
+
+// Decode unmarshals the table into the value pointed to by out, using `lua:"name"` struct tags
+func (table *LocalLuaTable) Decode(out interface{}, options ...DecodeOption) error {
+	unrolled, err := table.Unroll()
+	if err != nil {
+		return err
+	}
+
+	d := newDecoder(options)
+	err = decodeInto(unrolled, out, d)
+	d.closeUnused(unrolled)
+	return err
+}
+
+func (s *LuaState) GetGlobalInto(path string, out interface{}, options ...DecodeOption) error {
+	value, err := s.GetGlobal(path)
+	if err != nil {
+		return err
+	}
+
+	if table, isTable := value.(*LocalLuaTable); isTable {
+		defer table.Close()
+		return table.Decode(out, options...)
+	}
+
+	d := newDecoder(options)
+	err = decodeInto(value, out, d)
+	d.closeUnused(value)
+	return err
+}
@@ -5,30 +5,176 @@ package luajitter
 */
 import "C"
 import (
-	"errors"
-	"unsafe"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
 )
 
-func LuaErrorToGo(err *C.lua_err) error {
+type ErrorKind int
+
+const (
+	// ErrorKindAPI is used for errors raised by luajitter itself rather than by a protected call
+	ErrorKindAPI          ErrorKind = 0
+	ErrorKindRuntime      ErrorKind = C.LUA_ERRRUN
+	ErrorKindSyntax       ErrorKind = C.LUA_ERRSYNTAX
+	ErrorKindMemory       ErrorKind = C.LUA_ERRMEM
+	ErrorKindErrorHandler ErrorKind = C.LUA_ERRERR
+	// ErrorKindFile is used when a chunk's file could not be opened or read
+	ErrorKindFile ErrorKind = C.LUA_ERRFILE
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorKindAPI:
+		return "api"
+	case ErrorKindRuntime:
+		return "runtime"
+	case ErrorKindSyntax:
+		return "syntax"
+	case ErrorKindMemory:
+		return "memory"
+	case ErrorKindErrorHandler:
+		return "error handler"
+	case ErrorKindFile:
+		return "file"
+	}
+	return "unknown"
+}
+
+type LuaError struct {
+	Kind      ErrorKind
+	Message   string
+	ChunkName string
+	Line      int
+	Traceback string
+	// Value holds the original error value, with tables unrolled into maps. Values that would need a reference
+	// into lua to hold on to, such as functions, threads and userdata, are replaced with a description.
+	Value interface{}
+}
+
+func (e *LuaError) Error() string {
+	return e.Message
+}
+
+func (e *LuaError) Unwrap() error {
+	goErr, _ := e.Value.(error)
+	return goErr
+}
+
+var errorLocation = regexp.MustCompile(`^(\[string ".*?"\]|[^\n]+?):(\d+): `)
+
+func LuaErrorToGo(vm *LuaState, err *C.lua_err) error {
 	if err == nil {
 		return nil
 	}
-	if err == C.INVALID_ERROR {
-		panic("INVALID ERROR RAISED FROM LUA")
+
+	outErr := &LuaError{
+		Kind:    ErrorKind(err.errCode),
+		Message: C.GoString(err.message),
+	}
+	outErr.Value = outErr.Message
+	if err.value != nil {
+		outErr.Value = errorValueToGo(vm, err.value, outErr.Message)
+		err.value = nil
 	}
-	outErr := errors.New(C.GoString(err.message))
+	if err.traceback != nil {
+		outErr.Traceback = C.GoString(err.traceback)
+	}
+
+	location := errorLocation.FindStringSubmatch(outErr.Message)
+	if location != nil {
+		outErr.ChunkName = location[1]
+		outErr.Line, _ = strconv.Atoi(location[2])
+	}
+
 	return outErr
 }
 
-var luaErrSize C.size_t = C.size_t(unsafe.Sizeof(C.lua_err{}))
+func errorValueToGo(vm *LuaState, value *C.struct_lua_value, description string) interface{} {
+	goValue := buildGoValue(vm, value)
+	C.free_temporary_lua_value(vm._l, value)
+
+	table, isTable := goValue.(*LocalLuaTable)
+	if !isTable {
+		//Nothing would ever close an error's value, so it can't keep a ref alive
+		if data, isData := goValue.(LocalData); isData {
+			data.Close()
+			return description
+		}
+		return goValue
+	}
+	defer table.Close()
+
+	unrolled, err := table.Unroll()
+	if err != nil {
+		return nil
+	}
+	releaseErrorValues(unrolled, make(map[uintptr]bool))
+	return unrolled
+}
+
+// releaseErrorValues closes any local data in an unrolled error table, keys included, replacing it with a
+// description of its type
+func releaseErrorValues(table map[interface{}]interface{}, visited map[uintptr]bool) {
+	pointer := reflect.ValueOf(table).Pointer()
+	if visited[pointer] {
+		return
+	}
+	visited[pointer] = true
+
+	var localKeys []LocalData
+	for key, value := range table {
+		if localKey, isLocal := key.(LocalData); isLocal {
+			localKeys = append(localKeys, localKey)
+		}
+
+		switch v := value.(type) {
+		case map[interface{}]interface{}:
+			releaseErrorValues(v, visited)
+		case LocalData:
+			table[key] = fmt.Sprintf("(%s value)", luaTypeName(v))
+			v.Close()
+		}
+	}
+
+	for _, localKey := range localKeys {
+		value := table[localKey]
+		delete(table, localKey)
+
+		//Several keys of the same type would otherwise collapse into one entry
+		description := fmt.Sprintf("(%s key)", luaTypeName(localKey))
+		for i := 2; ; i++ {
+			if _, taken := table[description]; !taken {
+				break
+			}
+			description = fmt.Sprintf("(%s key %d)", luaTypeName(localKey), i)
+		}
+		table[description] = value
+		localKey.Close()
+	}
+}
+
+type CallbackPanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *CallbackPanicError) Error() string {
+	return fmt.Sprintf("go callback panicked: %v\n%s", e.Value, e.Stack)
+}
+
+func (e *CallbackPanicError) Unwrap() error {
+	goErr, _ := e.Value.(error)
+	return goErr
+}
 
 func GoErrorToLua(err error) *C.lua_err {
 	if err == nil {
 		return nil
 	}
 
-	outErr := (*C.struct_lua_err)(C.chmalloc(luaErrSize))
-	outErr.message = C.CString(err.Error())
+	outErr := C.create_lua_error(C.CString(err.Error()))
 	C.increment_allocs()
 	return outErr
 }
@@ -0,0 +1,86 @@
+package luajitter
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+type fieldInfo struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var fieldCache sync.Map
+
+// structFields lists the fields of a struct type as seen from lua, honouring `lua:"name,omitempty"` tags
+func structFields(structType reflect.Type) []fieldInfo {
+	if cached, ok := fieldCache.Load(structType); ok {
+		return cached.([]fieldInfo)
+	}
+
+	fields := collectFields(structType, nil)
+	fieldCache.Store(structType, fields)
+	return fields
+}
+
+func collectFields(structType reflect.Type, parentIndex []int) []fieldInfo {
+	var fields []fieldInfo
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		tag, hasTag := field.Tag.Lookup("lua")
+		if tag == "-" {
+			continue
+		}
+
+		index := make([]int, len(parentIndex)+1)
+		copy(index, parentIndex)
+		index[len(parentIndex)] = i
+
+		//Untagged embedded structs have their fields promoted, the same as encoding/json
+		if field.Anonymous && !hasTag && field.Type.Kind() == reflect.Struct {
+			fields = append(fields, collectFields(field.Type, index)...)
+			continue
+		}
+
+		if field.PkgPath != "" {
+			continue
+		}
+
+		info := fieldInfo{
+			name:  field.Name,
+			index: index,
+		}
+
+		tagParts := strings.Split(tag, ",")
+		if tagParts[0] != "" {
+			info.name = tagParts[0]
+		}
+		for _, option := range tagParts[1:] {
+			if option == "omitempty" {
+				info.omitEmpty = true
+			}
+		}
+
+		fields = append(fields, info)
+	}
+
+	return fields
+}
+
+func findField(fields []fieldInfo, name string) (fieldInfo, bool) {
+	for _, field := range fields {
+		if field.name == name {
+			return field, true
+		}
+	}
+
+	for _, field := range fields {
+		if strings.EqualFold(field.name, name) {
+			return field, true
+		}
+	}
+
+	return fieldInfo{}, false
+}
@@ -1,6 +1,6 @@
 module github.com/cannibalvox/luajitter
 
-go 1.14
+go 1.16
 
 require (
 	github.com/baohavan/go-pointer v0.0.0-20181113050700-6f48d0300d21
@@ -9,6 +9,73 @@ int release_cgo_handle(lua_State *_L) {
 	return 0;
 }
 
+int go_error_tostring(lua_State *_L) {
+    void **handle = (void**)lua_touserdata(_L, 1);
+    char *message = goErrorMessage(*handle);
+    lua_pushstring(_L, message);
+    free(message);
+    return 1;
+}
+
+static int is_go_error(lua_State *_L, int index) {
+    if (lua_type(_L, index) != LUA_TUSERDATA || !lua_getmetatable(_L, index))
+        return 0;
+    luaL_getmetatable(_L, MT_GOERROR);
+    int isGoError = lua_rawequal(_L, -1, -2);
+    lua_pop(_L, 2);
+    return isGoError;
+}
+
+//Replaces a go error at the given (absolute) index with its message
+static void go_error_to_string(lua_State *_L, int index) {
+    if (!is_go_error(_L, index))
+        return;
+    void **handle = (void**)lua_touserdata(_L, index);
+    char *message = goErrorMessage(*handle);
+    lua_pushstring(_L, message);
+    free(message);
+    lua_replace(_L, index);
+}
+
+int go_error_concat(lua_State *_L) {
+    lua_settop(_L, 2);
+    for (int i = 1; i <= 2; i++) {
+        go_error_to_string(_L, i);
+        if (!lua_isstring(_L, i))
+            return luaL_error(_L, "attempt to concatenate a %s value", luaL_typename(_L, i));
+    }
+    lua_concat(_L, 2);
+    return 1;
+}
+
+int go_error_method(lua_State *_L) {
+    int argCount = lua_gettop(_L);
+    if (argCount > 0)
+        go_error_to_string(_L, 1);
+    lua_pushvalue(_L, lua_upvalueindex(1));
+    lua_insert(_L, 1);
+    lua_call(_L, argCount, LUA_MULTRET);
+    return lua_gettop(_L);
+}
+
+int go_error_index(lua_State *_L) {
+    //Keys are looked up in the string library, with methods called on the message so err:match() keeps working
+    lua_settop(_L, 2);
+    lua_gettable(_L, lua_upvalueindex(1));
+    if (lua_isfunction(_L, -1))
+        lua_pushcclosure(_L, &go_error_method, 1);
+    return 1;
+}
+
+const char *get_calling_function_name(lua_State *_L) {
+    lua_Debug ar;
+    if (!lua_getstack(_L, 0, &ar))
+        return NULL;
+    if (!lua_getinfo(_L, "n", &ar))
+        return NULL;
+    return ar.name;
+}
+
 int execute_go_callback(lua_State *_L) {
     lua_args args = {};
     lua_err *err = NULL;
@@ -30,8 +97,7 @@ int execute_go_callback(lua_State *_L) {
     goReturn->valueCount = 0;
     goReturn->values = NULL;
 
-    lua_err *retErr = chmalloc(sizeof(lua_error));
-    retErr->message = NULL;
+    lua_err *retErr = create_lua_error(NULL);
 
     goReturn->err = retErr;
     callbackGoFunction(_L, *goCallback, args, goReturn);
@@ -44,7 +110,8 @@ int execute_go_callback(lua_State *_L) {
     if (goReturn->err != NULL) {
         err = goReturn->err;
         goReturn->err = NULL;
-        free_lua_return(_L, *goReturn, 1);
+        //Local values handed back by go still belong to go, only the ones built for the return are freed
+        free_temporary_lua_return(_L, *goReturn, 1);
         chfree(goReturn);
         return raise_lua_error(_L, err);
     }
@@ -59,3 +126,18 @@ int execute_go_callback(lua_State *_L) {
 
     return valueCount;
 }
+
+int execute_go_callback_upvalue(lua_State *_L) {
+    //Put the callback userdata where execute_go_callback expects the __call self argument to be
+    lua_pushvalue(_L, lua_upvalueindex(1));
+    lua_insert(_L, 1);
+    return execute_go_callback(_L);
+}
+
+const char *read_go_reader(lua_State *_L, void *data, size_t *size) {
+    go_reader *reader = (go_reader*)data;
+    *size = readGoReader(reader->handle, reader->buffer, reader->capacity);
+    if (*size == 0)
+        return NULL;
+    return reader->buffer;
+}
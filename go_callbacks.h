@@ -1,2 +1,16 @@
 extern int execute_go_callback(lua_State *_L);
+extern int execute_go_callback_upvalue(lua_State *_L);
 extern int release_cgo_handle(lua_State *_L);
+extern int go_error_tostring(lua_State *_L);
+extern int go_error_concat(lua_State *_L);
+extern int go_error_index(lua_State *_L);
+extern const char *get_calling_function_name(lua_State *_L);
+
+struct go_reader {
+    void *handle;
+    char *buffer;
+    size_t capacity;
+};
+typedef struct go_reader go_reader;
+
+extern const char *read_go_reader(lua_State *_L, void *data, size_t *size);
@@ -0,0 +1,99 @@
+#include "go_luajit.h"
+
+static const char *Int64HelpersKey = "internal_int64_helpers";
+
+#define INT64_HELPER_BOX 1
+#define INT64_HELPER_UNBOX 2
+
+//The lua C api has no way to build cdata, so the boxing is done through the ffi.  Values
+//cross as two 32-bit halves so that no precision is lost on the way through a lua number.
+static const char *Int64Helpers =
+    "local ffi = require('ffi')\n"
+    "local int64, uint64 = ffi.typeof('int64_t'), ffi.typeof('uint64_t')\n"
+    "local function box(isUnsigned, hi, lo)\n"
+    "    local value = uint64(hi) * 4294967296 + lo\n"
+    "    if isUnsigned then return value end\n"
+    "    return ffi.cast(int64, value)\n"
+    "end\n"
+    "local function unbox(value)\n"
+    "    local isUnsigned = ffi.istype(uint64, value)\n"
+    "    if not isUnsigned and not ffi.istype(int64, value) then return nil end\n"
+    "    value = ffi.cast(uint64, value)\n"
+    "    return isUnsigned, tonumber(value / 4294967296), tonumber(value % 4294967296)\n"
+    "end\n"
+    "return box, unbox\n";
+
+lua_err *enable_int64_cdata(lua_State *_L) {
+    int retVal = luaL_loadstring(_L, Int64Helpers);
+    if (retVal == 0)
+        retVal = pcall_with_traceback(_L, 0, 2);
+    if (retVal != 0)
+        return get_lua_error(_L, retVal);
+
+    lua_createtable(_L, 2, 0);
+    lua_insert(_L, -3);
+    lua_rawseti(_L, -3, INT64_HELPER_UNBOX);
+    lua_rawseti(_L, -2, INT64_HELPER_BOX);
+
+    lua_pushlightuserdata(_L, (void *)&Int64HelpersKey);
+    lua_insert(_L, -2);
+    lua_rawset(_L, LUA_REGISTRYINDEX);
+    return NULL;
+}
+
+static _Bool push_int64_helper(lua_State *_L, int helper) {
+    lua_pushlightuserdata(_L, (void *)&Int64HelpersKey);
+    lua_rawget(_L, LUA_REGISTRYINDEX);
+    if (!lua_istable(_L, -1)) {
+        lua_pop(_L, 1);
+        return 0;
+    }
+
+    lua_rawgeti(_L, -1, helper);
+    lua_remove(_L, -2);
+    return 1;
+}
+
+//Fills value from the cdata at the top of the stack if it's a boxed 64-bit integer, leaving the stack as it was
+_Bool unbox_int64(lua_State *_L, lua_value *value) {
+    if (!lua_checkstack(_L, 4) || !push_int64_helper(_L, INT64_HELPER_UNBOX))
+        return 0;
+
+    lua_pushvalue(_L, -2);
+    if (lua_pcall(_L, 1, 3, 0) != 0) {
+        lua_pop(_L, 1);
+        return 0;
+    }
+
+    if (lua_isnil(_L, -3)) {
+        lua_pop(_L, 3);
+        return 0;
+    }
+
+    _Bool isUnsigned = (_Bool)lua_toboolean(_L, -3);
+    uint64_t hi = (uint64_t)lua_tonumber(_L, -2);
+    uint64_t lo = (uint64_t)lua_tonumber(_L, -1);
+    lua_pop(_L, 3);
+
+    if (isUnsigned) {
+        value->valueType = LUA_TUINT64;
+        value->data.uint64Val = (hi << 32) | lo;
+    } else {
+        value->valueType = LUA_TINT64;
+        value->data.int64Val = (int64_t)((hi << 32) | lo);
+    }
+    return 1;
+}
+
+lua_err *box_int64(lua_State *_L, lua_value *value) {
+    if (!lua_checkstack(_L, 4))
+        return create_lua_error_from_luastr("stack overflow while boxing 64-bit integer");
+    if (!push_int64_helper(_L, INT64_HELPER_BOX))
+        return create_lua_error_from_luastr("64-bit integer cdata is not enabled for this state");
+
+    uint64_t bits = value->data.uint64Val;
+    lua_pushboolean(_L, value->valueType == LUA_TUINT64);
+    lua_pushnumber(_L, (lua_Number)(bits >> 32));
+    lua_pushnumber(_L, (lua_Number)(bits & 0xFFFFFFFF));
+    return get_lua_error(_L, lua_pcall(_L, 3, 1, 0));
+}
@@ -0,0 +1,3 @@
+extern lua_err *enable_int64_cdata(lua_State *_L);
+extern _Bool unbox_int64(lua_State *_L, lua_value *value);
+extern lua_err *box_int64(lua_State *_L, lua_value *value);
@@ -1,20 +1,105 @@
 #include "go_luajit.h"
 
-const lua_err INVALID_ERROR_str = {"INVALID ERROR"};
-lua_err *INVALID_ERROR = (lua_err *)&INVALID_ERROR_str;
+static const char *TracebackKey = "internal_error_traceback";
+
+char *take_error_traceback(lua_State *_L) {
+    char *traceback = NULL;
+
+    lua_pushlightuserdata(_L, (void *)&TracebackKey);
+    lua_rawget(_L, LUA_REGISTRYINDEX);
+    if (lua_type(_L, -1) == LUA_TSTRING) {
+        size_t length;
+        const char *luaStr = lua_tolstring(_L, -1, &length);
+        traceback = chmalloc(sizeof(char)*(length+1));
+        memcpy(traceback, luaStr, length+1);
+    }
+    lua_pop(_L, 1);
+
+    lua_pushlightuserdata(_L, (void *)&TracebackKey);
+    lua_pushnil(_L);
+    lua_rawset(_L, LUA_REGISTRYINDEX);
+
+    return traceback;
+}
+
+char *describe_error_value(lua_State *_L) {
+    size_t length;
+    const char *luaStr;
+
+    if (luaL_getmetafield(_L, -1, "__tostring")) {
+        lua_pushvalue(_L, -2);
+        if (lua_pcall(_L, 1, 1, 0) == 0 && lua_type(_L, -1) == LUA_TSTRING) {
+            luaStr = lua_tolstring(_L, -1, &length);
+            char *message = chmalloc(sizeof(char)*(length+1));
+            memcpy(message, luaStr, length+1);
+            lua_pop(_L, 1);
+            return message;
+        }
+        lua_pop(_L, 1);
+    }
+
+    if (lua_type(_L, -1) == LUA_TNUMBER) {
+        //Convert a copy so the number itself stays a number
+        lua_pushvalue(_L, -1);
+        luaStr = lua_tolstring(_L, -1, &length);
+        char *message = chmalloc(sizeof(char)*(length+1));
+        memcpy(message, luaStr, length+1);
+        lua_pop(_L, 1);
+        return message;
+    }
+
+    const char *format = "(error object is a %s value)";
+    const char *typeName = luaL_typename(_L, -1);
+    int messageLength = strlen(format) - 2 + strlen(typeName);
+    char *message = chmalloc(sizeof(char)*(messageLength+1));
+    snprintf(message, messageLength+1, format, typeName);
+    return message;
+}
 
 lua_err *get_lua_error(lua_State *_L, int errCode) {
     if (errCode == 0)
         return NULL;
-    if (errCode == LUA_ERRMEM)
-        return create_lua_error("LUA OUT OF MEMORY");
 
-	const char *message = lua_tolstring(_L, -1, NULL);
-	if (message == NULL)
-		return INVALID_ERROR;
+    lua_err *err;
+    if (errCode == LUA_ERRMEM) {
+        err = create_lua_error_from_luastr("LUA OUT OF MEMORY");
+        lua_pop(_L, 1);
+    } else if (lua_type(_L, -1) == LUA_TSTRING) {
+        err = create_lua_error_from_luastr(lua_tolstring(_L, -1, NULL));
+        lua_pop(_L, 1);
+    } else {
+        //Non-string error values are kept around so that golang can inspect them
+        err = create_lua_error(describe_error_value(_L));
+        lua_result value = convert_stack_value(_L);
+        if (value.err != NULL) {
+            lua_pop(_L, 1);
+            free_lua_error(_L, value.err);
+            free_lua_value(_L, value.value);
+            value.value = NULL;
+        }
+        err->value = value.value;
+    }
+
+    err->errCode = errCode;
+    err->traceback = take_error_traceback(_L);
+    return err;
+}
+
+int error_traceback_handler(lua_State *_L) {
+    //Stash the traceback on the side so the error value itself reaches get_lua_error untouched
+    lua_pushlightuserdata(_L, (void *)&TracebackKey);
+    luaL_traceback(_L, _L, NULL, 1);
+    lua_rawset(_L, LUA_REGISTRYINDEX);
+    return 1;
+}
 
-	lua_pop(_L, 1);
-	return create_lua_error_from_luastr(message);
+int pcall_with_traceback(lua_State *_L, int nargs, int nresults) {
+    int handlerIndex = lua_gettop(_L) - nargs;
+    lua_pushcfunction(_L, &error_traceback_handler);
+    lua_insert(_L, handlerIndex);
+    int resultCode = lua_pcall(_L, nargs, nresults, handlerIndex);
+    lua_remove(_L, handlerIndex);
+    return resultCode;
 }
 
 lua_err *create_lua_error_from_luastr(const char *msg) {
@@ -22,6 +107,9 @@ lua_err *create_lua_error_from_luastr(const char *msg) {
 	char *newMessage = chmalloc(sizeof(char)*(strlen(msg)+1));
 	strncpy(newMessage, msg, strlen(msg)+1);
 	err->message = newMessage;
+	err->traceback = NULL;
+	err->errCode = 0;
+	err->value = NULL;
 
 	return err;
 }
@@ -29,22 +117,37 @@ lua_err *create_lua_error_from_luastr(const char *msg) {
 lua_err *create_lua_error(char *msg) {
 	lua_err *err = chmalloc(sizeof(lua_err));
 	err->message = msg;
+	err->traceback = NULL;
+	err->errCode = 0;
+	err->value = NULL;
 
 	return err;
 }
 
-void free_lua_error(lua_err *err) {
+void free_lua_error(lua_State *_L, lua_err *err) {
     if (err == NULL)
         return;
 	chfree(err->message);
 	err->message = NULL;
+	if (err->traceback != NULL)
+	    chfree(err->traceback);
+	err->traceback = NULL;
+	if (err->value != NULL)
+	    free_lua_value(_L, err->value);
+	err->value = NULL;
     chfree(err);
 }
 
 int raise_lua_error(lua_State *_L, lua_err *err) {
     if (err == NULL)
         return 0;
-    lua_pushstring(_L, err->message);
-    free_lua_error(err);
+    lua_err *pushErr = NULL;
+    if (err->value != NULL)
+        pushErr = push_lua_value(_L, err->value);
+    if (err->value == NULL || pushErr != NULL) {
+        free_lua_error(_L, pushErr);
+        lua_pushstring(_L, err->message);
+    }
+    free_lua_error(_L, err);
     return lua_error(_L);
 }
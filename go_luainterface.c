@@ -10,10 +10,11 @@ lua_return call_function(lua_State *_L, lua_value *func, lua_args args) {
     }
     err = push_lua_args(_L, args);
     if (err != NULL) {
+        lua_settop(_L, startTop);
         retVal.err = err;
         return retVal;
     }
-    int resultCode = lua_pcall(_L, args.valueCount, LUA_MULTRET, 0);
+    int resultCode = pcall_with_traceback(_L, args.valueCount, LUA_MULTRET);
     retVal.err = get_lua_error(_L, resultCode);
     
     if (retVal.err == NULL) {
@@ -28,111 +29,394 @@ lua_return call_function(lua_State *_L, lua_value *func, lua_args args) {
     return retVal;
 }
 
-typedef lua_result (*last_segment_handler)(lua_State *_L, int depth, const char *fullPath, const char *segment);
+typedef lua_result (*last_segment_handler)(lua_State *_L, int depth, lua_value *key);
 
-lua_err *create_walk_error(const char *fullPath, const char *path, const char *error) {
-    int segLen;
-    for (segLen = 0; path[segLen] != '\0' && path[segLen] != '.'; segLen++) {}
+lua_err *create_walk_error(const char *fullPath, lua_value *key, const char *error) {
+    char numberSegment[32];
+    const char *segment = "?";
+    if (key != NULL) {
+        switch (key->valueType) {
+            case LUA_TSTRING:
+                segment = (const char*)key->data.pointerVal;
+                break;
+            case LUA_TNUMBER:
+                snprintf(numberSegment, sizeof(numberSegment), "%.14g", key->data.numberVal);
+                segment = numberSegment;
+                break;
+            case LUA_TBOOLEAN:
+                segment = key->data.booleanVal ? "true" : "false";
+                break;
+        }
+    }
 
-    const char *format = "Failed path walk in '%s' on '%.*s': %s";
-    int length = strlen(format) - 8 + strlen(fullPath) + segLen + strlen(error) ;
+    const char *format = "Failed path walk in '%s' on '%s': %s";
+    int length = strlen(format) - 6 + strlen(fullPath) + strlen(segment) + strlen(error);
     char *fullError = chmalloc(sizeof(char)*(length+1));
-    snprintf(fullError,length,format,fullPath,segLen,path,error);
+    snprintf(fullError,length+1,format,fullPath,segment,error);
     return create_lua_error(fullError);
 }
 
-void push_walk_key(lua_State *_L, const char *path, int segLen) {
-    char *outPath;
-    char *expectedFinishPath = (char*)(path+segLen);
-
-    int result = strtol(path, &outPath, 10);
-    if ((result != 0 || errno == 0) && expectedFinishPath == outPath) {
-        lua_pushinteger(_L, result);
-        return;
-    }
-
-    lua_pushlstring(_L, path, (size_t)segLen);
-}
-
-lua_result walk_next_segment(lua_State *_L, int depth, const char *fullPath, const char *path, last_segment_handler handler, _Bool fillIntermediateTables) {
+lua_result walk_next_segment(lua_State *_L, int depth, const char *fullPath, lua_args keys, last_segment_handler handler, _Bool fillIntermediateTables) {
     lua_result retVal = {};
+    lua_value *key = keys.values[depth-1];
     if (lua_isnil(_L, -1)) {
-        retVal.err = create_walk_error(fullPath, path, "nil segment");
+        retVal.err = create_walk_error(fullPath, key, "nil segment");
         return retVal;
     }
 
     if (!lua_istable(_L, -1)) {
-        retVal.err = create_walk_error(fullPath, path, "not table");
-        return retVal;
-    }
-
-    int segLen;
-    for (segLen = 0; path[segLen] != '\0' && path[segLen] != '.'; segLen++) {}
-    
-    if (segLen == 0) {
-        retVal.err = create_walk_error(fullPath, path, "walked path segment zero length");
+        retVal.err = create_walk_error(fullPath, key, "not table");
         return retVal;
     }
 
-    if (path[segLen] == '.') {
-        push_walk_key(_L, path, segLen);
+    if (depth < keys.valueCount) {
+        retVal.err = push_lua_value(_L, key);
+        if (retVal.err != NULL)
+            return retVal;
         lua_gettable(_L, -2);
         if (fillIntermediateTables && lua_isnil(_L, -1)) {
             //Remove nil from the stack
             lua_pop(_L, 1);
 
             //Push key & new table
-            push_walk_key(_L, path, segLen);
+            push_lua_value(_L, key);
             lua_newtable(_L);
             //Put new table into old one
             lua_settable(_L, -3);
 
             //Retry get now that the new table is in there
-            push_walk_key(_L, path, segLen);
+            push_lua_value(_L, key);
             lua_gettable(_L, -2);
         }
-        retVal = walk_next_segment(_L, depth+1, fullPath, path+segLen+1, handler, fillIntermediateTables);
+        retVal = walk_next_segment(_L, depth+1, fullPath, keys, handler, fillIntermediateTables);
         lua_pop(_L, 1);
         return retVal;
     }
 
-    return handler(_L, depth, fullPath, path);
+    return handler(_L, depth, key);
 }
 
-lua_result walk_table_path(lua_State *_L, int valueIndex, const char *path, last_segment_handler handler, _Bool fillIntermediateTables) {
+lua_result walk_table_path(lua_State *_L, int valueIndex, const char *fullPath, lua_args keys, last_segment_handler handler, _Bool fillIntermediateTables) {
+    if (keys.valueCount == 0) {
+        lua_result retVal = {};
+        retVal.err = create_walk_error(fullPath, NULL, "empty path");
+        return retVal;
+    }
+
     lua_pushvalue(_L, valueIndex);
-    lua_result retVal = walk_next_segment(_L, 1, path, path, handler, fillIntermediateTables);
+    lua_result retVal = walk_next_segment(_L, 1, fullPath, keys, handler, fillIntermediateTables);
     lua_pop(_L, 1);
     return retVal;
 }
 
-lua_result get_global_handler(lua_State *_L, int depth, const char *fullPath, const char *path) {
-    push_walk_key(_L, path, strlen(path));
+lua_result get_global_handler(lua_State *_L, int depth, lua_value *key) {
+    lua_result retVal = {};
+    retVal.err = push_lua_value(_L, key);
+    if (retVal.err != NULL)
+        return retVal;
     lua_gettable(_L, -2);
     return convert_stack_value(_L);
 }
 
-lua_result get_global(lua_State *_L, const char *path, _Bool fillIntermediateTables) {
-    lua_result retVal = walk_table_path(_L, LUA_GLOBALSINDEX, path, get_global_handler, fillIntermediateTables);
-    return retVal;
+struct path_walk {
+    const char *fullPath;
+    lua_args keys;
+    last_segment_handler handler;
+    _Bool fillIntermediateTables;
+    int valueIndex;
+    lua_result result;
+};
+typedef struct path_walk path_walk;
+
+//Walks run under pcall, any table along the path may have metamethods that raise errors
+int protected_walk_table_path(lua_State *_L) {
+    //Arguments are the walk, then the table to start from (unless walking globals), then the value being set
+    path_walk *walk = (path_walk*)lua_touserdata(_L, 1);
+    lua_remove(_L, 1);
+    walk->result = walk_table_path(_L, walk->valueIndex, walk->fullPath, walk->keys, walk->handler, walk->fillIntermediateTables);
+    return 0;
 }
 
-lua_result set_global_handler(lua_State *_L, int depth, const char *fullPath, const char *path) {
-    push_walk_key(_L, path, strlen(path));
+lua_result run_path_walk(lua_State *_L, path_walk *walk, lua_value *table, _Bool setValue, lua_value *value) {
+    lua_result retVal = {};
+    int startTop = lua_gettop(_L);
+    walk->valueIndex = table == NULL ? LUA_GLOBALSINDEX : 1;
+
+    lua_pushcfunction(_L, &protected_walk_table_path);
+    lua_pushlightuserdata(_L, walk);
+    lua_err *err = NULL;
+    if (table != NULL)
+        err = push_lua_value(_L, table);
+    if (err == NULL && setValue)
+        err = push_lua_value(_L, value);
+    if (err != NULL) {
+        lua_settop(_L, startTop);
+        retVal.err = err;
+        return retVal;
+    }
+
+    int resultCode = pcall_with_traceback(_L, lua_gettop(_L) - startTop - 1, 0);
+    retVal.err = get_lua_error(_L, resultCode);
+    if (retVal.err != NULL)
+        return retVal;
+    return walk->result;
+}
+
+lua_result get_global(lua_State *_L, const char *fullPath, lua_args keys, _Bool fillIntermediateTables) {
+    path_walk walk = {fullPath, keys, get_global_handler, fillIntermediateTables};
+    return run_path_walk(_L, &walk, NULL, 0, NULL);
+}
+
+lua_result set_global_handler(lua_State *_L, int depth, lua_value *key) {
+    lua_result res = {};
+    res.err = push_lua_value(_L, key);
+    if (res.err != NULL)
+        return res;
     lua_pushvalue(_L, -2-depth);
     lua_settable(_L, -3);
-    lua_result res = {};
     return res;
 }
 
-lua_err *set_global(lua_State *_L, const char *path, lua_value *value, _Bool fillIntermediateTables) {
+lua_err *set_global(lua_State *_L, const char *fullPath, lua_args keys, lua_value *value, _Bool fillIntermediateTables) {
+    //The value sits directly below the walk, where set_global_handler expects it
+    path_walk walk = {fullPath, keys, set_global_handler, fillIntermediateTables};
+    lua_result result = run_path_walk(_L, &walk, NULL, 1, value);
+    if (result.value) {
+        free_lua_value(_L, result.value);
+    }
+    return result.err;
+}
+
+lua_result get_path(lua_State *_L, lua_value *table, const char *fullPath, lua_args keys, _Bool fillIntermediateTables) {
+    path_walk walk = {fullPath, keys, get_global_handler, fillIntermediateTables};
+    return run_path_walk(_L, &walk, table, 0, NULL);
+}
+
+lua_err *set_path(lua_State *_L, lua_value *table, const char *fullPath, lua_args keys, lua_value *value, _Bool fillIntermediateTables) {
+    path_walk walk = {fullPath, keys, set_global_handler, fillIntermediateTables};
+    lua_result result = run_path_walk(_L, &walk, table, 1, value);
+    if (result.value) {
+        free_lua_value(_L, result.value);
+    }
+    return result.err;
+}
+
+lua_result new_table(lua_State *_L, int arraySize, int hashSize) {
+    lua_createtable(_L, arraySize, hashSize);
+    return convert_stack_value(_L);
+}
+
+//Table access goes through pcall, metamethods and bad keys can both raise errors
+int protected_table_get(lua_State *_L) {
+    //Arguments are table, key, raw
+    int raw = lua_toboolean(_L, 3);
+    lua_settop(_L, 2);
+    if (raw)
+        lua_rawget(_L, 1);
+    else
+        lua_gettable(_L, 1);
+    return 1;
+}
+
+int protected_table_set(lua_State *_L) {
+    //Arguments are table, key, value, raw
+    int raw = lua_toboolean(_L, 4);
+    lua_settop(_L, 3);
+    if (raw)
+        lua_rawset(_L, 1);
+    else
+        lua_settable(_L, 1);
+    return 0;
+}
+
+lua_result table_get(lua_State *_L, lua_value *table, lua_value *key, _Bool raw) {
+    lua_result retVal = {};
+    int startTop = lua_gettop(_L);
+    lua_pushcfunction(_L, &protected_table_get);
+    lua_err *err = push_lua_value(_L, table);
+    if (err == NULL)
+        err = push_lua_value(_L, key);
+    if (err != NULL) {
+        lua_settop(_L, startTop);
+        retVal.err = err;
+        return retVal;
+    }
+    lua_pushboolean(_L, raw);
+
+    int resultCode = pcall_with_traceback(_L, 3, 1);
+    retVal.err = get_lua_error(_L, resultCode);
+    if (retVal.err != NULL)
+        return retVal;
+
+    return convert_stack_value(_L);
+}
+
+lua_err *table_set(lua_State *_L, lua_value *table, lua_value *key, lua_value *value, _Bool raw) {
+    int startTop = lua_gettop(_L);
+    lua_pushcfunction(_L, &protected_table_set);
+    lua_err *err = push_lua_value(_L, table);
+    if (err == NULL)
+        err = push_lua_value(_L, key);
+    if (err == NULL)
+        err = push_lua_value(_L, value);
+    if (err != NULL) {
+        lua_settop(_L, startTop);
+        return err;
+    }
+    lua_pushboolean(_L, raw);
+
+    int resultCode = pcall_with_traceback(_L, 4, 0);
+    return get_lua_error(_L, resultCode);
+}
+
+void release_ref(lua_State *_L, int ref) {
+    luaL_unref(_L, LUA_REGISTRYINDEX, ref);
+}
+
+size_t table_len(lua_State *_L, lua_value *table) {
+    lua_rawgeti(_L, LUA_REGISTRYINDEX, table->data.luaRefVal);
+    size_t length = lua_objlen(_L, -1);
+    lua_pop(_L, 1);
+    return length;
+}
+
+int protected_table_next(lua_State *_L) {
+    //Arguments are table, key
+    lua_settop(_L, 2);
+    if (!lua_next(_L, 1))
+        return 0;
+
+    //The key goes to golang converted, so the iteration continues from a ref to the original- a converted
+    //key can come back as a different value, such as a new box for int64 cdata
+    lua_pushvalue(_L, -2);
+    lua_pushnumber(_L, luaL_ref(_L, LUA_REGISTRYINDEX));
+    lua_insert(_L, -3);
+    return 3;
+}
+
+lua_return table_next(lua_State *_L, lua_value *table, int keyRef) {
+    lua_return retVal = {};
+    int startTop = lua_gettop(_L);
+    lua_pushcfunction(_L, &protected_table_next);
+    lua_err *err = push_lua_value(_L, table);
+    if (err != NULL) {
+        lua_settop(_L, startTop);
+        luaL_unref(_L, LUA_REGISTRYINDEX, keyRef);
+        retVal.err = err;
+        return retVal;
+    }
+    lua_rawgeti(_L, LUA_REGISTRYINDEX, keyRef);
+    luaL_unref(_L, LUA_REGISTRYINDEX, keyRef);
+
+    int resultCode = pcall_with_traceback(_L, 2, LUA_MULTRET);
+    retVal.err = get_lua_error(_L, resultCode);
+    if (retVal.err != NULL)
+        return retVal;
+
+    int popValues = lua_gettop(_L) - startTop;
+    if (popValues == 0)
+        return retVal;
+
+    return pop_lua_values(_L, popValues);
+}
+
+lua_result get_metatable(lua_State *_L, lua_value *value) {
+    lua_result retVal = {};
+    retVal.err = push_lua_value(_L, value);
+    if (retVal.err != NULL)
+        return retVal;
+
+    if (!lua_getmetatable(_L, -1)) {
+        lua_pop(_L, 1);
+        return retVal;
+    }
+
+    lua_remove(_L, -2);
+    return convert_stack_value(_L);
+}
+
+lua_err *set_metatable(lua_State *_L, lua_value *value, lua_value *metatable) {
     lua_err *err = push_lua_value(_L, value);
     if (err != NULL)
         return err;
-    lua_result result = walk_table_path(_L, LUA_GLOBALSINDEX, path, set_global_handler, fillIntermediateTables);
+
+    err = push_lua_value(_L, metatable);
+    if (err != NULL) {
+        lua_pop(_L, 1);
+        return err;
+    }
+
+    lua_setmetatable(_L, -2);
     lua_pop(_L, 1);
-    if (result.value) {
-        free_lua_value(_L, result.value);
+    return NULL;
+}
+
+lua_result new_metatable(lua_State *_L, const char *name) {
+    //If the name is already registered, the existing metatable is returned
+    luaL_newmetatable(_L, name);
+    return convert_stack_value(_L);
+}
+
+lua_result load_buffer(lua_State *_L, const char *source, size_t length, const char *chunkName, const char *mode) {
+    lua_result retVal = {};
+    int resultCode = luaL_loadbufferx(_L, source, length, chunkName, mode);
+    if (resultCode != 0) {
+        retVal.err = get_lua_error(_L, resultCode);
+        return retVal;
     }
-    return result.err;
+    return convert_stack_value(_L);
+}
+
+lua_result load_file(lua_State *_L, const char *path, const char *mode) {
+    lua_result retVal = {};
+    int resultCode = luaL_loadfilex(_L, path, mode);
+    if (resultCode != 0) {
+        retVal.err = get_lua_error(_L, resultCode);
+        return retVal;
+    }
+    return convert_stack_value(_L);
+}
+
+#define READER_BUFFER_SIZE 16384
+
+lua_result load_reader(lua_State *_L, void *handle, const char *chunkName, const char *mode) {
+    lua_result retVal = {};
+    //The source is handed to lua a buffer at a time, so it never has to be in memory all at once
+    go_reader reader;
+    reader.handle = handle;
+    reader.capacity = READER_BUFFER_SIZE;
+    reader.buffer = chmalloc(sizeof(char)*READER_BUFFER_SIZE);
+
+    int resultCode = lua_loadx(_L, &read_go_reader, &reader, chunkName, mode);
+    chfree(reader.buffer);
+    if (resultCode != 0) {
+        retVal.err = get_lua_error(_L, resultCode);
+        return retVal;
+    }
+    return convert_stack_value(_L);
+}
+
+lua_result dump_function(lua_State *_L, lua_value *function, _Bool strip) {
+    lua_result retVal = {};
+    //string.dump is the only way to strip debug info, lua_dump always writes it
+    push_string_dump(_L);
+    lua_err *err = push_lua_value(_L, function);
+    if (err != NULL) {
+        lua_pop(_L, 1);
+        retVal.err = err;
+        return retVal;
+    }
+
+    int argCount = 1;
+    if (strip) {
+        lua_pushliteral(_L, "s");
+        argCount++;
+    }
+
+    int resultCode = pcall_with_traceback(_L, argCount, 1);
+    if (resultCode != 0) {
+        retVal.err = get_lua_error(_L, resultCode);
+        return retVal;
+    }
+    return convert_stack_value(_L);
 }
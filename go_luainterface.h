@@ -1,3 +1,18 @@
 extern lua_return call_function(lua_State *_L, lua_value *func, lua_args args);
-extern lua_result get_global(lua_State *_L, const char *path, _Bool fillIntermediateTables);
-extern lua_err *set_global(lua_State *_L, const char *path, lua_value *value, _Bool fillIntermediateTables);
+extern lua_result get_global(lua_State *_L, const char *fullPath, lua_args keys, _Bool fillIntermediateTables);
+extern lua_result new_table(lua_State *_L, int arraySize, int hashSize);
+extern lua_result table_get(lua_State *_L, lua_value *table, lua_value *key, _Bool raw);
+extern lua_err *table_set(lua_State *_L, lua_value *table, lua_value *key, lua_value *value, _Bool raw);
+extern size_t table_len(lua_State *_L, lua_value *table);
+extern lua_return table_next(lua_State *_L, lua_value *table, int keyRef);
+extern void release_ref(lua_State *_L, int ref);
+extern lua_result get_metatable(lua_State *_L, lua_value *value);
+extern lua_err *set_metatable(lua_State *_L, lua_value *value, lua_value *metatable);
+extern lua_result new_metatable(lua_State *_L, const char *name);
+extern lua_result load_buffer(lua_State *_L, const char *source, size_t length, const char *chunkName, const char *mode);
+extern lua_result load_file(lua_State *_L, const char *path, const char *mode);
+extern lua_result load_reader(lua_State *_L, void *handle, const char *chunkName, const char *mode);
+extern lua_result dump_function(lua_State *_L, lua_value *function, _Bool strip);
+extern lua_err *set_global(lua_State *_L, const char *fullPath, lua_args keys, lua_value *value, _Bool fillIntermediateTables);
+extern lua_result get_path(lua_State *_L, lua_value *table, const char *fullPath, lua_args keys, _Bool fillIntermediateTables);
+extern lua_err *set_path(lua_State *_L, lua_value *table, const char *fullPath, lua_args keys, lua_value *value, _Bool fillIntermediateTables);
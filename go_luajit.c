@@ -1,14 +1,30 @@
 #include "go_luajit.h"
 
-lua_err *internal_dostring(lua_State *_L, char *script) {
-	int retVal = luaL_dostring(_L, script);
+lua_err *internal_dostring(lua_State *_L, char *script, const char *mode) {
+	int retVal = luaL_loadbufferx(_L, script, strlen(script), script, mode);
+	if (retVal == 0)
+		retVal = pcall_with_traceback(_L, 0, 0);
 	return get_lua_error(_L, retVal);
 }
 
+static const char *MainThreadKey = "internal_main_thread";
+static const char *StringDumpKey = "internal_string_dump";
+
 lua_State *new_luajit_state() {
 	lua_State *_L = luaL_newstate();
 	luaL_openlibs(_L);
 
+	lua_pushlightuserdata(_L, (void *)&MainThreadKey);
+	lua_pushthread(_L);
+	lua_rawset(_L, LUA_REGISTRYINDEX);
+
+	//Keep our own copy of string.dump so that sandboxing the string library doesn't break dumping from go
+	lua_pushlightuserdata(_L, (void *)&StringDumpKey);
+	lua_getglobal(_L, "string");
+	lua_getfield(_L, -1, "dump");
+	lua_remove(_L, -2);
+	lua_rawset(_L, LUA_REGISTRYINDEX);
+
 	luaL_newmetatable(_L, MT_GOCALLBACK);
 	lua_pushliteral(_L,"__call");
 	lua_pushcfunction(_L,&execute_go_callback);
@@ -19,11 +35,51 @@ lua_State *new_luajit_state() {
 	lua_settable(_L,-3);
 	lua_pop(_L,1);
 
+	luaL_newmetatable(_L, MT_GOERROR);
+	lua_pushliteral(_L,"__tostring");
+	lua_pushcfunction(_L,&go_error_tostring);
+	lua_settable(_L,-3);
+
+	//Go errors used to reach lua as strings, so they still concatenate and take string methods like one
+	lua_pushliteral(_L,"__concat");
+	lua_pushcfunction(_L,&go_error_concat);
+	lua_settable(_L,-3);
+
+	lua_pushliteral(_L,"__index");
+	lua_getglobal(_L,"string");
+	lua_pushcclosure(_L,&go_error_index,1);
+	lua_settable(_L,-3);
+
+	lua_pushliteral(_L,"__gc");
+	lua_pushcfunction(_L,&release_cgo_handle);
+	lua_settable(_L,-3);
+	lua_pop(_L,1);
+
+	//The rest of the proxy metamethods are go functions, golang fills them in once the state is registered
+	luaL_newmetatable(_L, MT_GOPROXY);
+	lua_pushliteral(_L,"__gc");
+	lua_pushcfunction(_L,&release_cgo_handle);
+	lua_settable(_L,-3);
+	lua_pop(_L,1);
+
 	init_pools(_L);
 
 	return _L;
 }
 
+void push_string_dump(lua_State *_L) {
+	lua_pushlightuserdata(_L, (void *)&StringDumpKey);
+	lua_rawget(_L, LUA_REGISTRYINDEX);
+}
+
+lua_State *get_main_thread(lua_State *_L) {
+	lua_pushlightuserdata(_L, (void *)&MainThreadKey);
+	lua_rawget(_L, LUA_REGISTRYINDEX);
+	lua_State *mainThread = lua_tothread(_L, -1);
+	lua_pop(_L, 1);
+	return mainThread;
+}
+
 void close_lua(lua_State *_L) {
     free_pools(_L);
     lua_close(_L);
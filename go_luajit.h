@@ -6,17 +6,23 @@
 #include <lualib.h>
 #include <string.h>
 #include <errno.h>
+#include <stdint.h>
 
 #define MT_GOCALLBACK "GO_CALLBACK"
+#define MT_GOERROR "GO_ERROR"
+#define MT_GOPROXY "GO_PROXY"
 
 #include "go_diag_memory.h"
 #include "go_luaerrors.h"
 #include "go_luatypes.h"
 #include "go_pools.h"
 #include "go_luainterface.h"
+#include "go_int64.h"
 
 #include "go_callbacks.h"
 
-extern lua_err *internal_dostring(lua_State *_L, char *script);
+extern lua_err *internal_dostring(lua_State *_L, char *script, const char *mode);
+extern void push_string_dump(lua_State *_L);
 extern lua_State *new_luajit_state();
+extern lua_State *get_main_thread(lua_State *_L);
 extern void close_lua(lua_State *_L);
\ No newline at end of file
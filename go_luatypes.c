@@ -62,6 +62,7 @@ void free_lua_value_impl(lua_State *L, lua_value *value, _Bool deletePermanent)
         case LUA_TTHREAD:
         case LUA_TLIGHTUSERDATA:
         case LUA_TTABLE:
+        case LUA_TCDATA:
             luaL_unref(L, LUA_REGISTRYINDEX, value->data.luaRefVal);
             break;
         case LUA_TUNROLLEDTABLE:
@@ -83,7 +84,7 @@ void free_lua_return(lua_State *_L, lua_return retVal, _Bool freeValues) {
 
 void free_lua_return_impl(lua_State *_L, lua_return retVal, _Bool freeValues, _Bool deletePermanent) {
     if (retVal.err != NULL)
-        free_lua_error(retVal.err);
+        free_lua_error(_L, retVal.err);
     
     if (freeValues) {
         for (int i = 0; i < retVal.valueCount; i++) {
@@ -114,47 +115,92 @@ void free_lua_args_impl(lua_State *_L, lua_args args, _Bool freeValues, _Bool de
     chfree(args.values);
 }
 
-lua_result unroll_table(lua_State *_L, lua_value *table) {
-    int luaRefVal = table->data.luaRefVal;
-    lua_result retVal;
-    lua_unrolled_table *unrolled = make_lua_unrolled_table(_L);
-    retVal.err = NULL;
-    retVal.value = make_lua_value(_L);
-    retVal.value->valueType = LUA_TUNROLLEDTABLE;
-    retVal.value->data.pointerVal = NULL;
-    retVal.value->temporary = 0;
+lua_result unroll_stack_table(lua_State *_L, int visitedIndex, int depth, int maxDepth);
+
+lua_result unroll_table(lua_State *_L, lua_value *table, int maxDepth) {
+    lua_result retVal = {};
+    if (!lua_checkstack(_L, 2)) {
+        retVal.err = create_lua_error_from_luastr("stack overflow while unrolling table");
+        return retVal;
+    }
+
+    //Tables already unrolled are tracked so that cycles and shared tables become references
+    lua_newtable(_L);
+    int visitedIndex = lua_gettop(_L);
 
     //Push rolled table to top of stack
-    lua_rawgeti(_L, LUA_REGISTRYINDEX, luaRefVal);
+    lua_rawgeti(_L, LUA_REGISTRYINDEX, table->data.luaRefVal);
+    retVal = unroll_stack_table(_L, visitedIndex, 1, maxDepth);
+
+    //remove visited table to cleanup
+    lua_pop(_L, 1);
+    return retVal;
+}
+
+//Unrolls the table at the top of the stack and pops it
+lua_result unroll_stack_table(lua_State *_L, int visitedIndex, int depth, int maxDepth) {
+    lua_result retVal = {};
+    int tableIndex = lua_gettop(_L);
+
+    if (maxDepth > 0 && depth > maxDepth) {
+        const char *format = "table nesting exceeds maximum unroll depth of %d";
+        char *message = chmalloc(sizeof(char)*(strlen(format)+20));
+        snprintf(message, strlen(format)+20, format, maxDepth);
+        retVal.err = create_lua_error(message);
+        lua_settop(_L, tableIndex-1);
+        return retVal;
+    }
+
+    if (!lua_checkstack(_L, 4)) {
+        retVal.err = create_lua_error_from_luastr("stack overflow while unrolling table");
+        lua_settop(_L, tableIndex-1);
+        return retVal;
+    }
 
+    lua_pushvalue(_L, tableIndex);
+    lua_rawget(_L, visitedIndex);
+    if (!lua_isnil(_L, -1)) {
+        retVal.value = make_lua_value(_L);
+        retVal.value->valueType = LUA_TUNROLLEDREF;
+        retVal.value->data.pointerVal = lua_touserdata(_L, -1);
+        retVal.value->temporary = 0;
+        lua_settop(_L, tableIndex-1);
+        return retVal;
+    }
+    lua_pop(_L, 1);
+
+    lua_unrolled_table *unrolled = make_lua_unrolled_table(_L);
     unrolled->first = NULL;
     unrolled->last = NULL;
     unrolled->arraySize = 0;
     unrolled->hashSize = 0;
 
+    retVal.value = make_lua_value(_L);
+    retVal.value->valueType = LUA_TUNROLLEDTABLE;
+    retVal.value->data.pointerVal = (void*)unrolled;
+    retVal.value->temporary = 0;
+
+    lua_pushvalue(_L, tableIndex);
+    lua_pushlightuserdata(_L, (void*)unrolled);
+    lua_rawset(_L, visitedIndex);
+
     lua_pushnil(_L); // First key to start iteration
 
-    while (lua_next(_L, -2)) {
-        lua_result key;
-        lua_result value = convert_stack_value(_L);
+    while (lua_next(_L, tableIndex)) {
+        lua_result key = {};
+        lua_result value;
 
-        if (value.err == NULL && value.value != NULL && value.value->valueType == LUA_TTABLE) {
-            lua_result nextValue = unroll_table(_L, value.value);
-            free_lua_value(_L, value.value);
-            value = nextValue;
+        if (lua_type(_L, -1) == LUA_TTABLE) {
+            value = unroll_stack_table(_L, visitedIndex, depth+1, maxDepth);
+        } else {
+            value = convert_stack_value(_L);
         }
 
+        //Table keys are left rolled up, golang can't use an unrolled table as a map key
         if (value.err == NULL) {
             key = convert_stack_value_impl(_L, 1);
-
-            if (key.err == NULL && key.value != NULL && key.value->valueType == LUA_TTABLE) {
-                lua_result nextKey = unroll_table(_L, key.value);
-                free_lua_value(_L, key.value);
-                key = nextKey;
-            }
         }
 
-
         if (value.err != NULL || key.err != NULL) {
             //Move error over to output
             if (value.err != NULL) {
@@ -168,11 +214,11 @@ lua_result unroll_table(lua_State *_L, lua_value *table) {
             if (value.value != NULL) free_lua_value(_L, value.value);
 
             //Free the unrolled table in progress
-            free_unrolled_table(_L, unrolled, 1);
+            free_lua_value(_L, retVal.value);
             retVal.value = NULL;
 
-            //Pop table from stack
-            lua_pop(_L, 1);
+            //Pop iteration state & table from stack
+            lua_settop(_L, tableIndex-1);
 
             return retVal;
         }
@@ -181,11 +227,10 @@ lua_result unroll_table(lua_State *_L, lua_value *table) {
 
         //We should increment the array count or hash count
         if (key.value->valueType == LUA_TNUMBER) {
-            float number = key.value->data.numberVal;
+            double number = key.value->data.numberVal;
 
-            if (number > 0) {
-                //We can be off by a little if we need to, so don't bohter figuring out
-                //if number is an integer
+            //Only positive integer keys can be part of a sequence
+            if (number >= 1 && number <= 4294967295.0 && number == (double)(unsigned int)number) {
                 unrolled->arraySize = unrolled->arraySize+1;
             } else {
                 unrolled->hashSize = unrolled->hashSize+1;
@@ -206,14 +251,53 @@ lua_result unroll_table(lua_State *_L, lua_value *table) {
         }
      }
 
-     retVal.value->data.pointerVal = (void*)unrolled;
-
      //remove table to cleanup
-     lua_pop(_L, 1);
+     lua_settop(_L, tableIndex-1);
 
      return retVal;
 }
 
+static const char *TypeMetatablesKey = "internal_type_metatables";
+static const char *TypeIdKey = "internal_type_id";
+
+//Reads the registered type id out of the metatable at the top of the stack, 0 if it isn't a registered type
+int get_type_id(lua_State *_L) {
+    lua_pushlightuserdata(_L, (void *)&TypeIdKey);
+    lua_rawget(_L, -2);
+    int typeId = 0;
+    if (lua_type(_L, -1) == LUA_TNUMBER)
+        typeId = (int)lua_tointeger(_L, -1);
+    lua_pop(_L, 1);
+    return typeId;
+}
+
+lua_result new_type_metatable(lua_State *_L, int typeId) {
+    //Registered types keep their metatables in a registry table indexed by type id
+    lua_pushlightuserdata(_L, (void *)&TypeMetatablesKey);
+    lua_rawget(_L, LUA_REGISTRYINDEX);
+    if (!lua_istable(_L, -1)) {
+        lua_pop(_L, 1);
+        lua_newtable(_L);
+        lua_pushlightuserdata(_L, (void *)&TypeMetatablesKey);
+        lua_pushvalue(_L, -2);
+        lua_rawset(_L, LUA_REGISTRYINDEX);
+    }
+
+    lua_newtable(_L);
+    lua_pushliteral(_L, "__gc");
+    lua_pushcfunction(_L, &release_cgo_handle);
+    lua_rawset(_L, -3);
+
+    lua_pushlightuserdata(_L, (void *)&TypeIdKey);
+    lua_pushinteger(_L, typeId);
+    lua_rawset(_L, -3);
+
+    lua_pushvalue(_L, -1);
+    lua_rawseti(_L, -3, typeId);
+    lua_remove(_L, -2);
+    return convert_stack_value(_L);
+}
+
 _Bool isUData(lua_State *_L, const char *name) {
     luaL_getmetatable(_L, name);
     int equal = lua_rawequal(_L, -1, -2);
@@ -255,16 +339,22 @@ lua_result convert_stack_value_impl(lua_State *L, _Bool suppressPop) {
             {
                 const char *luaStr = lua_tolstring(L, -1, &(retVal.value->dataArg.stringLen));
                 char *outStr = chmalloc(sizeof(char)*(retVal.value->dataArg.stringLen+1));
-                strncpy(outStr, luaStr, retVal.value->dataArg.stringLen+1);
+                //Lua strings can hold embedded zeroes, so copy by length rather than up to the first one
+                memcpy(outStr, luaStr, retVal.value->dataArg.stringLen+1);
                 retVal.value->data.pointerVal = (void*)outStr;
                 break;
             }
         case LUA_TFUNCTION:
             {
+                //C closures can't be rebuilt from the function pointer alone, they're stored as refs like lua functions
                 if (lua_iscfunction(L, -1)) {
-                    retVal.value->dataArg.isCFunction = 1;
-                    retVal.value->data.pointerVal = (void*)lua_tocfunction(L, -1);
-                    break;
+                    if (lua_getupvalue(L, -1, 1) == NULL) {
+                        retVal.value->dataArg.isCFunction = 1;
+                        retVal.value->data.pointerVal = (void*)lua_tocfunction(L, -1);
+                        break;
+                    }
+                    //lua_getupvalue pushed the upvalue, it's the closure underneath that gets stored
+                    lua_pop(L, 1);
                 }
                 //Intentionally falling through- lua functions need to be stored as refs
             }
@@ -277,20 +367,40 @@ lua_result convert_stack_value_impl(lua_State *L, _Bool suppressPop) {
                     if (gotMeta) {
                         if (isUData(L, MT_GOCALLBACK))
                             retVal.value->dataArg.userDataType = META_GOCALLBACK;
+                        else if (isUData(L, MT_GOERROR))
+                            retVal.value->dataArg.userDataType = META_GOERROR;
+                        else if (isUData(L, MT_GOPROXY))
+                            retVal.value->dataArg.userDataType = META_GOPROXY;
+                        else {
+                            int typeId = get_type_id(L);
+                            if (typeId > 0)
+                                retVal.value->dataArg.userDataType = META_GOTYPE_BASE + typeId;
+                        }
                         lua_pop(L, 1);
                     }
                 }
 
+                //Intentional fallthrough
+            }
+        case LUA_TCDATA:
+            {
+                //Boxed 64-bit integers come across as values, any other cdata is kept as a ref
+                if (type == LUA_TCDATA && unbox_int64(L, retVal.value))
+                    break;
+
                 //Intentional fallthrough
             }
         case LUA_TTHREAD:
         case LUA_TLIGHTUSERDATA:
         case LUA_TTABLE:
+            //luaL_ref pops the value, so ref a copy if the caller needs it left alone
+            if (suppressPop)
+                lua_pushvalue(L, -1);
             retVal.value->data.luaRefVal = luaL_ref(L, LUA_REGISTRYINDEX);
             needsPop = 0;
             break;
         default:
-            retVal.err = create_lua_error("CANNOT POP FROM STACK - INVALID STACK VALUE");
+            retVal.err = create_lua_error_from_luastr("CANNOT POP FROM STACK - INVALID STACK VALUE");
             needsPop = 0;
             break;
     }
@@ -360,6 +470,47 @@ lua_err *push_lua_value(lua_State *_L, lua_value *value) {
                 lua_setmetatable(_L, -2);
                 break;
             }
+        case LUA_TGOFUNCTION:
+            {
+                //This came from golang, it's a cgo handle for a go function that needs to be a real function
+                //rather than a callable userdata, so the callback userdata is wrapped up as a closure's upvalue
+                void **userData = (void**)lua_newuserdata(_L, sizeof(void*));
+                *userData = value->data.pointerVal;
+                luaL_getmetatable(_L, MT_GOCALLBACK);
+                lua_setmetatable(_L, -2);
+                lua_pushcclosure(_L, &execute_go_callback_upvalue, 1);
+                break;
+            }
+        case LUA_TGOPROXY:
+            {
+                //This came from golang, it's a cgo handle for a go value exposed through its fields & methods
+                void **userData = (void**)lua_newuserdata(_L, sizeof(void*));
+                *userData = value->data.pointerVal;
+                luaL_getmetatable(_L, MT_GOPROXY);
+                lua_setmetatable(_L, -2);
+                break;
+            }
+        case LUA_TGOUSERDATA:
+            {
+                //This came from golang, it's a cgo handle for a value of a registered go type
+                void **userData = (void**)lua_newuserdata(_L, sizeof(void*));
+                *userData = value->data.pointerVal;
+                lua_pushlightuserdata(_L, (void *)&TypeMetatablesKey);
+                lua_rawget(_L, LUA_REGISTRYINDEX);
+                lua_rawgeti(_L, -1, value->dataArg.userDataType - META_GOTYPE_BASE);
+                lua_setmetatable(_L, -3);
+                lua_pop(_L, 1);
+                break;
+            }
+        case LUA_TGOERROR:
+            {
+                //This came from golang, it's a cgo handle for a go error
+                void **userData = (void**)lua_newuserdata(_L, sizeof(void*));
+                *userData = value->data.pointerVal;
+                luaL_getmetatable(_L, MT_GOERROR);
+                lua_setmetatable(_L, -2);
+                break;
+            }
         case LUA_TNUMBER:
             lua_pushnumber(_L, (lua_Number)value->data.numberVal);
             break;
@@ -381,12 +532,16 @@ lua_err *push_lua_value(lua_State *_L, lua_value *value) {
         case LUA_TTHREAD:
         case LUA_TLIGHTUSERDATA:
         case LUA_TTABLE:
+        case LUA_TCDATA:
             lua_rawgeti(_L, LUA_REGISTRYINDEX, value->data.luaRefVal);
             break;
+        case LUA_TINT64:
+        case LUA_TUINT64:
+            return box_int64(_L, value);
         case LUA_TUNROLLEDTABLE:
             return push_unrolled_table(_L, (lua_unrolled_table*)value->data.pointerVal);
         default:
-            return create_lua_error("CANNOT PUSH TO STACK - INVALID VALUE");
+            return create_lua_error_from_luastr("CANNOT PUSH TO STACK - INVALID VALUE");
     }
 
     return NULL;
@@ -448,10 +603,19 @@ lua_unrolled_table *build_unrolled_table(lua_State *L, int entries) {
     return table;
 }
 
+void *get_userdata_handle(lua_State *_L, lua_value *value) {
+    lua_rawgeti(_L, LUA_REGISTRYINDEX, value->data.luaRefVal);
+    void **handle = (void**)lua_touserdata(_L, -1);
+    lua_pop(_L, 1);
+    if (handle == NULL)
+        return NULL;
+    return *handle;
+}
+
 lua_value **build_values(lua_State *_L, int slots, int allocs) {
     lua_value** valueList = chmalloc(sizeof(lua_value*)*slots);
-    for (int i = 0; i < allocs; i++) {
-        valueList[i] = make_lua_value(_L);
+    for (int i = 0; i < slots; i++) {
+        valueList[i] = i < allocs ? make_lua_value(_L) : NULL;
     }
     return valueList;
 }
\ No newline at end of file
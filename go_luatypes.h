@@ -1,13 +1,29 @@
 #define LUA_TUNLOADEDCALLBACK -1
 #define LUA_TUNROLLEDTABLE -2
+#define LUA_TGOERROR -3
+#define LUA_TUNROLLEDREF -4
+#define LUA_TINT64 -5
+#define LUA_TUINT64 -6
+#define LUA_TGOFUNCTION -7
+#define LUA_TGOPROXY -8
+#define LUA_TGOUSERDATA -9
+
+//LuaJIT's cdata type, which lua.h does not define
+#define LUA_TCDATA 10
 
 #define META_GOCALLBACK 1
+#define META_GOERROR 2
+#define META_GOPROXY 3
+//Userdata of a registered go type report META_GOTYPE_BASE plus the type id
+#define META_GOTYPE_BASE 16
 
 union lua_primitive {
     double numberVal;
     _Bool booleanVal;
     void *pointerVal;
     int luaRefVal;
+    int64_t int64Val;
+    uint64_t uint64Val;
 };
 typedef union lua_primitive lua_primitive;
 
@@ -83,5 +99,7 @@ extern lua_err *push_lua_value(lua_State *_L, lua_value *value);
 extern lua_err *push_lua_args(lua_State *_L, lua_args args);
 extern lua_err *push_lua_return(lua_State *_L, lua_return retVal);
 extern lua_value **build_values(lua_State *_L, int slots, int allocs);
-extern lua_result unroll_table(lua_State *_L, lua_value *table);
+extern lua_result unroll_table(lua_State *_L, lua_value *table, int maxDepth);
 extern lua_unrolled_table *build_unrolled_table(lua_State *L, int entries);
+extern void *get_userdata_handle(lua_State *_L, lua_value *value);
+extern lua_result new_type_metatable(lua_State *_L, int typeId);
@@ -122,9 +122,14 @@ void return_lua_unrolled_table(lua_State *L, lua_unrolled_table *table) {
 lua_value *make_lua_value(lua_State *L) {
     ObjectPool *pool = get_obj_pool(L, &ValuePoolKey);
     lua_value *value = (lua_value*)get_from_pool(pool);
-    if (value != NULL)
-        return value;
-    return chmalloc(sizeof(lua_value));
+    if (value == NULL)
+        value = chmalloc(sizeof(lua_value));
+
+    //Values are frequently freed before they are filled in, so they need to be safe to free
+    value->valueType = LUA_TNIL;
+    value->data.pointerVal = NULL;
+    value->temporary = 1;
+    return value;
 }
 
 void return_lua_value(lua_State *L, lua_value *value) {
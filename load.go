@@ -0,0 +1,132 @@
+package luajitter
+
+/*
+#include "go_luajit.h"
+*/
+import "C"
+import (
+	"github.com/baohavan/go-pointer"
+	"io"
+	"strings"
+	"unsafe"
+)
+
+// luaChunkName turns a chunk name into the form lua expects. Names starting with '@' or '=' are passed through,
+// anything else is treated as a file name so that error messages read "name:line:". An empty name uses the
+// source itself, the same as luaL_loadstring.
+func luaChunkName(chunkName string, source string) string {
+	if chunkName == "" {
+		return source
+	}
+	if strings.HasPrefix(chunkName, "@") || strings.HasPrefix(chunkName, "=") {
+		return chunkName
+	}
+	return "@" + chunkName
+}
+
+// chunkMode is the lua_load mode used for source chunks: "t" accepts only text, "bt" accepts text or bytecode
+func (s *LuaState) chunkMode() string {
+	if s.textOnly {
+		return "t"
+	}
+	return "bt"
+}
+
+func (s *LuaState) loadResult(cResult C.struct_lua_result) (*LocalLuaFunction, error) {
+	if cResult.err != nil {
+		defer C.free_lua_error(s._l, cResult.err)
+		return nil, LuaErrorToGo(s, cResult.err)
+	}
+	return buildGoValue(s, cResult.value).(*LocalLuaFunction), nil
+}
+
+// LoadString compiles source without running it. The returned function runs the chunk each time it is called.
+// Syntax errors are returned as a *LuaError of kind ErrorKindSyntax, with the chunk name and line filled in.
+func (s *LuaState) LoadString(source string, chunkName string) (*LocalLuaFunction, error) {
+	cSource := C.CString(source)
+	defer C.free(unsafe.Pointer(cSource))
+	cChunkName := C.CString(luaChunkName(chunkName, source))
+	defer C.free(unsafe.Pointer(cChunkName))
+
+	mode := C.CString(s.chunkMode())
+	defer C.free(unsafe.Pointer(mode))
+
+	return s.loadResult(C.load_buffer(s._l, cSource, C.size_t(len(source)), cChunkName, mode))
+}
+
+// LoadFile compiles the file at path without running it. Files that can't be read return a *LuaError of kind
+// ErrorKindFile.
+func (s *LuaState) LoadFile(path string) (*LocalLuaFunction, error) {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	mode := C.CString(s.chunkMode())
+	defer C.free(unsafe.Pointer(mode))
+
+	return s.loadResult(C.load_file(s._l, cPath, mode))
+}
+
+// LoadBytecode loads a function previously written by LocalLuaFunction.Dump or string.dump. Source text is
+// refused, use LoadString for that. Bytecode is not verified, so it should only come from a trusted source.
+func (s *LuaState) LoadBytecode(bytecode []byte, chunkName string) (*LocalLuaFunction, error) {
+	if chunkName == "" {
+		chunkName = "=(bytecode)"
+	}
+	cBytecode := C.CBytes(bytecode)
+	defer C.free(cBytecode)
+	cChunkName := C.CString(luaChunkName(chunkName, ""))
+	defer C.free(unsafe.Pointer(cChunkName))
+	mode := C.CString("b")
+	defer C.free(unsafe.Pointer(mode))
+
+	return s.loadResult(C.load_buffer(s._l, (*C.char)(cBytecode), C.size_t(len(bytecode)), cChunkName, mode))
+}
+
+// LoadReader compiles the chunk read from r without running it. The source is read a buffer at a time rather than
+// being copied into memory first, and an error from r is returned in place of the compile result.
+func (s *LuaState) LoadReader(r io.Reader, chunkName string) (*LocalLuaFunction, error) {
+	if chunkName == "" {
+		chunkName = "=(load)"
+	}
+	cChunkName := C.CString(luaChunkName(chunkName, ""))
+	defer C.free(unsafe.Pointer(cChunkName))
+
+	state := &chunkReader{reader: r}
+	handle := pointer.Save(state)
+	defer pointer.Unref(handle)
+
+	mode := C.CString(s.chunkMode())
+	defer C.free(unsafe.Pointer(mode))
+
+	fn, err := s.loadResult(C.load_reader(s._l, handle, cChunkName, mode))
+	if state.err != nil {
+		if fn != nil {
+			fn.Close()
+		}
+		return nil, state.err
+	}
+	return fn, err
+}
+
+// DoStringNamed runs source as a chunk called name, so that errors and tracebacks point at `name:line`
+// rather than at a snippet of the source
+func (s *LuaState) DoStringNamed(name string, source string) error {
+	_, err := s.EvalNamed(name, source)
+	return err
+}
+
+// Eval runs source and returns whatever the chunk returns
+func (s *LuaState) Eval(source string) ([]interface{}, error) {
+	return s.EvalNamed("", source)
+}
+
+// EvalNamed runs source as a chunk called name and returns whatever the chunk returns
+func (s *LuaState) EvalNamed(name string, source string) ([]interface{}, error) {
+	chunk, err := s.LoadString(source, name)
+	if err != nil {
+		return nil, err
+	}
+	defer chunk.Close()
+
+	return chunk.Call()
+}
@@ -12,6 +12,8 @@ type LocalLuaFunction struct {
 }
 
 func (f *LocalLuaFunction) Call(args ...interface{}) ([]interface{}, error) {
+	defer f.HomeVM().rethrowPendingPanic()
+
 	luaArgs := C.lua_args{
 		valueCount: C.int(len(args)),
 		values:     nil,
@@ -41,8 +43,8 @@ func (f *LocalLuaFunction) Call(args ...interface{}) ([]interface{}, error) {
 	var allRetVals []interface{}
 	retVal := C.call_function(f.HomeVM()._l, f.LuaValue(), luaArgs)
 	if retVal.err != nil {
-		defer C.free_lua_error(retVal.err)
-		err = LuaErrorToGo(retVal.err)
+		defer C.free_lua_error(f.HomeVM()._l, retVal.err)
+		err = LuaErrorToGo(f.HomeVM(), retVal.err)
 	} else if retVal.valueCount > 0 {
 		defer C.free_temporary_lua_return(f.HomeVM()._l, retVal, C._Bool(true))
 		valueList := (*[1 << 30]*C.struct_lua_value)(unsafe.Pointer(retVal.values))
@@ -51,3 +53,20 @@ func (f *LocalLuaFunction) Call(args ...interface{}) ([]interface{}, error) {
 
 	return allRetVals, err
 }
+
+// Dump returns the function as LuaJIT bytecode, which LoadBytecode can load back much faster than the source can
+// be compiled. Stripping drops debug info such as line numbers and local names. Upvalues are not saved, and go
+// or C functions can't be dumped.
+func (f *LocalLuaFunction) Dump(strip bool) ([]byte, error) {
+	vm := f.HomeVM()
+	cResult := C.dump_function(vm._l, f.LuaValue(), C._Bool(strip))
+	if cResult.err != nil {
+		defer C.free_lua_error(vm._l, cResult.err)
+		return nil, LuaErrorToGo(vm, cResult.err)
+	}
+	defer C.free_lua_value(vm._l, cResult.value)
+
+	union := (*unsafe.Pointer)(unsafe.Pointer(&cResult.value.data))
+	length := (*C.size_t)(unsafe.Pointer(&cResult.value.dataArg))
+	return C.GoBytes(*union, C.int(*length)), nil
+}
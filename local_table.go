@@ -5,42 +5,108 @@ package luajitter
 */
 import "C"
 
-import "unsafe"
+import (
+	"errors"
+	"unsafe"
+)
 
 type LocalLuaTable struct {
 	LocalLuaData
 }
 
-func (table *LocalLuaTable) convertSingleUnrolledValue(value *C.struct_lua_value) (interface{}, error) {
-	if value.valueType == C.LUA_TUNROLLEDTABLE {
+// isSequence reports whether an unrolled table's keys are exactly 1..n
+func isSequence(unrolled *C.struct_lua_unrolled_table) bool {
+	if unrolled.hashSize > 0 {
+		return false
+	}
+
+	for entry := unrolled.first; entry != nil; entry = entry.next {
+		number := *(*C.double)(unsafe.Pointer(&entry.key.data))
+		if number > C.double(unrolled.arraySize) {
+			return false
+		}
+	}
+
+	return true
+}
+
+const DefaultUnrollMaxDepth = 1000
+
+type unroller struct {
+	table     *LocalLuaTable
+	maxDepth  int
+	sequences bool
+	converted map[*C.struct_lua_unrolled_table]interface{}
+}
+
+type UnrollOption func(*unroller)
+
+// UnrollMaxDepth limits how deeply nested tables may be unrolled, 0 removes the limit
+func UnrollMaxDepth(depth int) UnrollOption {
+	return func(u *unroller) {
+		u.maxDepth = depth
+	}
+}
+
+func (u *unroller) convertSingleUnrolledValue(value *C.struct_lua_value) (interface{}, error) {
+	tablePtr := (**C.struct_lua_unrolled_table)(unsafe.Pointer(&value.data))
+	switch value.valueType {
+	case C.LUA_TUNROLLEDTABLE:
 		value.temporary = C._Bool(true)
-		tablePtr := (**C.struct_lua_unrolled_table)(unsafe.Pointer(&value.data))
-		return table.convertUnrolledTable(*tablePtr)
+		if u.sequences && (*tablePtr).arraySize > 0 && isSequence(*tablePtr) {
+			return u.convertUnrolledSequence(*tablePtr)
+		}
+		return u.convertUnrolledTable(*tablePtr)
+	case C.LUA_TUNROLLEDREF:
+		//Tables seen more than once share the same go value, the same as they do in lua
+		value.temporary = C._Bool(true)
+		return u.converted[*tablePtr], nil
 	}
 
-	return buildGoValue(table.HomeVM(), value), nil
+	return buildGoValue(u.table.HomeVM(), value), nil
 }
 
-func (table *LocalLuaTable) convertUnrolledTable(unrolled *C.struct_lua_unrolled_table) (map[interface{}]interface{}, error) {
+func (u *unroller) convertUnrolledTable(unrolled *C.struct_lua_unrolled_table) (map[interface{}]interface{}, error) {
 	retVal := make(map[interface{}]interface{}, unrolled.arraySize+unrolled.hashSize)
+	u.converted[unrolled] = retVal
 	var entry *C.struct_lua_table_entry
 	entry = unrolled.first
 
 	for entry != nil {
-		key, err := table.convertSingleUnrolledValue(entry.key)
+		key := buildGoKey(u.table.HomeVM(), entry.key)
+
+		value, err := u.convertSingleUnrolledValue(entry.value)
 		if err != nil {
-			C.free_lua_value(table.HomeVM()._l, entry.key)
+			C.free_lua_value(u.table.HomeVM()._l, entry.key)
+			C.free_lua_value(u.table.HomeVM()._l, entry.value)
 			return nil, err
 		}
 
-		value, err := table.convertSingleUnrolledValue(entry.value)
+		retVal[key] = value
+
+		entry = entry.next
+	}
+
+	return retVal, nil
+}
+
+func (u *unroller) convertUnrolledSequence(unrolled *C.struct_lua_unrolled_table) ([]interface{}, error) {
+	retVal := make([]interface{}, unrolled.arraySize)
+	u.converted[unrolled] = retVal
+	var entry *C.struct_lua_table_entry
+	entry = unrolled.first
+
+	for entry != nil {
+		index := int(*(*C.double)(unsafe.Pointer(&entry.key.data)))
+		entry.key.temporary = C._Bool(true)
+
+		value, err := u.convertSingleUnrolledValue(entry.value)
 		if err != nil {
-			C.free_lua_value(table.HomeVM()._l, entry.key)
-			C.free_lua_value(table.HomeVM()._l, entry.value)
+			C.free_lua_value(u.table.HomeVM()._l, entry.value)
 			return nil, err
 		}
 
-		retVal[key] = value
+		retVal[index-1] = value
 
 		entry = entry.next
 	}
@@ -48,16 +114,25 @@ func (table *LocalLuaTable) convertUnrolledTable(unrolled *C.struct_lua_unrolled
 	return retVal, nil
 }
 
-func (table *LocalLuaTable) Unroll() (map[interface{}]interface{}, error) {
-	result := C.unroll_table(table.HomeVM()._l, table.LuaValue())
+func (table *LocalLuaTable) unroll(options []UnrollOption, convert func(*unroller, *C.struct_lua_unrolled_table) (interface{}, error)) (interface{}, error) {
+	u := &unroller{
+		table:     table,
+		maxDepth:  DefaultUnrollMaxDepth,
+		converted: make(map[*C.struct_lua_unrolled_table]interface{}),
+	}
+	for _, option := range options {
+		option(u)
+	}
+
+	result := C.unroll_table(table.HomeVM()._l, table.LuaValue(), C.int(u.maxDepth))
 	if result.err != nil {
-		defer C.free_lua_error(result.err)
-		return nil, LuaErrorToGo(result.err)
+		defer C.free_lua_error(table.HomeVM()._l, result.err)
+		return nil, LuaErrorToGo(table.HomeVM(), result.err)
 	} else if result.value != nil {
 		result.value.temporary = C._Bool(true)
 		unrollTablePtr := (**C.struct_lua_unrolled_table)(unsafe.Pointer(&result.value.data))
 		unrollTable := *unrollTablePtr
-		retVal, err := table.convertUnrolledTable(unrollTable)
+		retVal, err := convert(u, unrollTable)
 		if err != nil {
 			C.free_lua_value(table.HomeVM()._l, result.value)
 			return nil, err
@@ -68,3 +143,234 @@ func (table *LocalLuaTable) Unroll() (map[interface{}]interface{}, error) {
 	}
 	return nil, nil
 }
+
+// Unroll copies the table into go. Nested tables are unrolled as well, tables used as keys are left as
+// LocalLuaTables and tables reachable more than once (including cycles) become the same go map.
+func (table *LocalLuaTable) Unroll(options ...UnrollOption) (map[interface{}]interface{}, error) {
+	retVal, err := table.unroll(options, func(u *unroller, unrolled *C.struct_lua_unrolled_table) (interface{}, error) {
+		return u.convertUnrolledTable(unrolled)
+	})
+	if retVal == nil {
+		return nil, err
+	}
+	return retVal.(map[interface{}]interface{}), err
+}
+
+// UnrollSlice unrolls a table whose keys are exactly 1..n, converting any nested sequences to slices as well
+func (table *LocalLuaTable) UnrollSlice(options ...UnrollOption) ([]interface{}, error) {
+	retVal, err := table.unroll(options, func(u *unroller, unrolled *C.struct_lua_unrolled_table) (interface{}, error) {
+		if !isSequence(unrolled) {
+			return nil, errors.New("cannot unroll table as slice: table is not a sequence")
+		}
+		u.sequences = true
+		return u.convertUnrolledSequence(unrolled)
+	})
+	if retVal == nil {
+		return nil, err
+	}
+	return retVal.([]interface{}), err
+}
+
+func (table *LocalLuaTable) get(key interface{}, raw bool) (interface{}, error) {
+	vm := table.HomeVM()
+	defer vm.rethrowPendingPanic()
+
+	cKey, err := fromGoKey(vm, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cKey != nil && cKey.temporary == C._Bool(true) {
+		defer C.free_temporary_lua_value(vm._l, cKey)
+	}
+
+	cResult := C.table_get(vm._l, table.LuaValue(), cKey, C._Bool(raw))
+	if cResult.err != nil {
+		defer C.free_lua_error(vm._l, cResult.err)
+		return nil, LuaErrorToGo(vm, cResult.err)
+	}
+
+	result := buildGoValue(vm, cResult.value)
+	C.free_temporary_lua_value(vm._l, cResult.value)
+	return result, nil
+}
+
+func (table *LocalLuaTable) set(key interface{}, value interface{}, raw bool) error {
+	vm := table.HomeVM()
+	defer vm.rethrowPendingPanic()
+
+	cKey, err := fromGoKey(vm, key, nil)
+	if err != nil {
+		return err
+	}
+	if cKey != nil && cKey.temporary == C._Bool(true) {
+		defer C.free_temporary_lua_value(vm._l, cKey)
+	}
+
+	cValue, err := fromGoValue(vm, value, nil)
+	if err != nil {
+		return err
+	}
+	if cValue != nil && cValue.temporary == C._Bool(true) {
+		defer C.free_temporary_lua_value(vm._l, cValue)
+	}
+
+	cErr := C.table_set(vm._l, table.LuaValue(), cKey, cValue, C._Bool(raw))
+	defer C.free_lua_error(vm._l, cErr)
+	return LuaErrorToGo(vm, cErr)
+}
+
+// Get reads table[key], honouring __index
+func (table *LocalLuaTable) Get(key interface{}) (interface{}, error) {
+	return table.get(key, false)
+}
+
+// RawGet reads table[key] without invoking metamethods
+func (table *LocalLuaTable) RawGet(key interface{}) (interface{}, error) {
+	return table.get(key, true)
+}
+
+// Set assigns table[key] = value, honouring __newindex
+func (table *LocalLuaTable) Set(key interface{}, value interface{}) error {
+	return table.set(key, value, false)
+}
+
+// RawSet assigns table[key] = value without invoking metamethods
+func (table *LocalLuaTable) RawSet(key interface{}, value interface{}) error {
+	return table.set(key, value, true)
+}
+
+// Delete removes key from the table without invoking metamethods. Assigning nil to a missing key would otherwise
+// call __newindex.
+func (table *LocalLuaTable) Delete(key interface{}) error {
+	return table.set(key, nil, true)
+}
+
+// Len returns the length of the table as reported by the # operator, without invoking metamethods
+func (table *LocalLuaTable) Len() int {
+	return int(C.table_len(table.HomeVM()._l, table.LuaValue()))
+}
+
+func (table *LocalLuaTable) getPath(path string, createIntermediateTables bool) (interface{}, error) {
+	keys, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	vm := table.HomeVM()
+	defer vm.rethrowPendingPanic()
+
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	var result interface{}
+	err = withPathKeys(vm, keys, func(cKeys C.lua_args) error {
+		cResult := C.get_path(vm._l, table.LuaValue(), cPath, cKeys, (C._Bool)(createIntermediateTables))
+		if cResult.err != nil {
+			defer C.free_lua_error(vm._l, cResult.err)
+			return LuaErrorToGo(vm, cResult.err)
+		}
+
+		result = buildGoValue(vm, cResult.value)
+		C.free_temporary_lua_value(vm._l, cResult.value)
+		return nil
+	})
+	return result, err
+}
+
+// GetPath reads a path such as "db.host" relative to this table, using the same syntax as GetGlobal
+func (table *LocalLuaTable) GetPath(path string) (interface{}, error) {
+	return table.getPath(path, false)
+}
+
+func (table *LocalLuaTable) setPath(path string, value interface{}, createIntermediateTables bool) error {
+	keys, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+
+	vm := table.HomeVM()
+	defer vm.rethrowPendingPanic()
+
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	cValue, err := fromGoValue(vm, value, nil)
+	if err != nil {
+		return err
+	}
+	if cValue != nil && cValue.temporary == C._Bool(true) {
+		defer C.free_temporary_lua_value(vm._l, cValue)
+	}
+
+	return withPathKeys(vm, keys, func(cKeys C.lua_args) error {
+		cErr := C.set_path(vm._l, table.LuaValue(), cPath, cKeys, cValue, (C._Bool)(createIntermediateTables))
+		defer C.free_lua_error(vm._l, cErr)
+		return LuaErrorToGo(vm, cErr)
+	})
+}
+
+// SetPath assigns to a dot-separated path relative to this table, every table along the way must already exist
+func (table *LocalLuaTable) SetPath(path string, value interface{}) error {
+	return table.setPath(path, value, false)
+}
+
+// InitPath assigns to a dot-separated path relative to this table, creating any missing tables along the way
+func (table *LocalLuaTable) InitPath(path string, value interface{}) error {
+	return table.setPath(path, value, true)
+}
+
+// ForEach calls fn with each key and value in the table, in the order lua's next returns them, without unrolling
+// the whole table first. Returning false from fn stops the iteration. Tables, functions and userdata are passed as
+// local data, the same as with Unroll, and must be closed by fn if it does not hold on to them. Assigning to keys
+// that are not already in the table during the iteration is an error.
+func (table *LocalLuaTable) ForEach(fn func(key interface{}, value interface{}) bool) error {
+	vm := table.HomeVM()
+	defer vm.rethrowPendingPanic()
+
+	//The key to continue from is held in the registry, table_next releases it once the next key is found
+	iterKey := C.int(C.LUA_NOREF)
+	defer func() {
+		C.release_ref(vm._l, iterKey)
+	}()
+
+	for {
+		cReturn := C.table_next(vm._l, table.LuaValue(), iterKey)
+		iterKey = C.LUA_NOREF
+		if cReturn.err != nil {
+			defer C.free_lua_error(vm._l, cReturn.err)
+			return LuaErrorToGo(vm, cReturn.err)
+		}
+		if cReturn.valueCount == 0 {
+			return nil
+		}
+
+		values := (*[1 << 30]*C.struct_lua_value)(unsafe.Pointer(cReturn.values))
+		iterKey = C.int(*(*C.double)(unsafe.Pointer(&values[0].data)))
+		values[0].temporary = C._Bool(true)
+		key := buildGoKey(vm, values[1])
+		value := buildGoValue(vm, values[2])
+		C.free_temporary_lua_return(vm._l, cReturn, C._Bool(true))
+
+		if !fn(key, value) {
+			return nil
+		}
+	}
+}
+
+// ForEachArray calls fn with table[1], table[2] and so on until it reaches a nil, the same as ipairs.
+// Returning false from fn stops the iteration.
+func (table *LocalLuaTable) ForEachArray(fn func(index int, value interface{}) bool) error {
+	for index := 1; ; index++ {
+		value, err := table.RawGet(index)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			return nil
+		}
+
+		if !fn(index, value) {
+			return nil
+		}
+	}
+}
@@ -8,6 +8,8 @@ package luajitter
 */
 import "C"
 import (
+	"io/fs"
+	"reflect"
 	"unsafe"
 )
 
@@ -15,14 +17,104 @@ var vmMap = make(map[*C.lua_State]*LuaState)
 
 type LuaState struct {
 	_l *C.lua_State
+
+	panicMode      PanicMode
+	pendingPanic   *CallbackPanicError
+	stringsAsBytes bool
+	int64Cdata     bool
+	int64Numbers   bool
+	textOnly       bool
+	moduleFS       fs.FS
+	modulePaths    []string
+	marshaling     map[interface{}]struct{}
+
+	registeredTypes map[reflect.Type]*registeredType
+}
+
+type PanicMode int
+
+const (
+	// PanicModeConvert turns panics in go callbacks into lua errors
+	PanicModeConvert PanicMode = iota
+	// PanicModeRepanic unwinds lua with an error, then panics again once control returns to go
+	PanicModeRepanic
+)
+
+type StateOption func(*LuaState)
+
+func WithPanicMode(mode PanicMode) StateOption {
+	return func(s *LuaState) {
+		s.panicMode = mode
+	}
+}
+
+// WithStringsAsBytes returns lua strings to go as []byte rather than string. Table keys are still returned as strings.
+func WithStringsAsBytes() StateOption {
+	return func(s *LuaState) {
+		s.stringsAsBytes = true
+	}
+}
+
+// WithInt64Cdata marshals go int64 and uint64 values into lua as LuaJIT's boxed int64_t and uint64_t cdata, so
+// that they keep their full precision. Boxed integers coming back out of lua are returned as int64 and uint64.
+// Table keys are the exception: boxes compare by identity, so int64 and uint64 keys are still passed as lua numbers,
+// and keys a lua number can't hold exactly are an error.
+func WithInt64Cdata() StateOption {
+	return func(s *LuaState) {
+		s.int64Cdata = true
+	}
 }
 
-func NewState() *LuaState {
+// WithIntegersAsInt64 returns lua numbers that hold an integral value as int64 rather than float64
+func WithIntegersAsInt64() StateOption {
+	return func(s *LuaState) {
+		s.int64Numbers = true
+	}
+}
+
+// WithTextOnlyChunks refuses precompiled bytecode in DoString and the Load and Eval functions, which should be used
+// when loading untrusted input. LoadBytecode is unaffected.
+func WithTextOnlyChunks() StateOption {
+	return func(s *LuaState) {
+		s.textOnly = true
+	}
+}
+
+func NewState(options ...StateOption) *LuaState {
 	vm := C.new_luajit_state()
 	state := &LuaState{
 		_l: vm,
 	}
 	vmMap[vm] = state
+
+	for _, option := range options {
+		option(state)
+	}
+
+	err := state.initProxyMetatable()
+	if err != nil {
+		state.Close()
+		panic(err)
+	}
+
+	if state.int64Cdata {
+		cErr := C.enable_int64_cdata(vm)
+		if cErr != nil {
+			//Only possible when LuaJIT was built without the ffi library
+			err := LuaErrorToGo(state, cErr)
+			C.free_lua_error(vm, cErr)
+			state.Close()
+			panic(err)
+		}
+	}
+
+	if state.moduleFS != nil {
+		err = state.installModuleSearcher()
+		if err != nil {
+			state.Close()
+			panic(err)
+		}
+	}
 	return state
 }
 
@@ -32,44 +124,92 @@ func (s *LuaState) Close() error {
 	return nil
 }
 
+func (s *LuaState) rethrowPendingPanic() {
+	if s.pendingPanic == nil {
+		return
+	}
+
+	pendingPanic := s.pendingPanic
+	s.pendingPanic = nil
+	panic(pendingPanic)
+}
+
 func (s *LuaState) DoString(doString string) error {
+	defer s.rethrowPendingPanic()
+
 	script := C.CString(doString)
 	defer C.free(unsafe.Pointer(script))
 
-	cErr := C.internal_dostring(s._l, script)
+	mode := C.CString(s.chunkMode())
+	defer C.free(unsafe.Pointer(mode))
 
-	defer C.free_lua_error(cErr)
-	return LuaErrorToGo(cErr)
+	cErr := C.internal_dostring(s._l, script, mode)
+
+	defer C.free_lua_error(s._l, cErr)
+	return LuaErrorToGo(s, cErr)
 }
 
-func (s *LuaState) getGlobal(path string, createIntermediateTables bool) (interface{}, error) {
+func (s *LuaState) NewTable() (*LocalLuaTable, error) {
+	cResult := C.new_table(s._l, 0, 0)
+	defer C.free_lua_error(s._l, cResult.err)
+
+	err := LuaErrorToGo(s, cResult.err)
+	if err != nil {
+		return nil, err
+	}
+	return buildGoValue(s, cResult.value).(*LocalLuaTable), nil
+}
+
+func (s *LuaState) getGlobal(path string, keys []interface{}, createIntermediateTables bool) (interface{}, error) {
+	defer s.rethrowPendingPanic()
+
 	cPath := C.CString(path)
 	defer C.free(unsafe.Pointer(cPath))
 
-	cResult := C.get_global(s._l, cPath, (C._Bool)(createIntermediateTables))
-	defer C.free_lua_error(cResult.err)
-
-	err := LuaErrorToGo(cResult.err)
 	var result interface{}
-	if cResult.value != nil {
-		valArray := (*[1 << 30]*C.struct_lua_value)(unsafe.Pointer(&cResult.value))
-		vals := buildGoValues(s, 1, valArray)
-		if len(vals) > 0 {
-			result = vals[0]
-			if valArray[0] != nil {
-				C.free_temporary_lua_value(s._l, valArray[0])
+	err := withPathKeys(s, keys, func(cKeys C.lua_args) error {
+		cResult := C.get_global(s._l, cPath, cKeys, (C._Bool)(createIntermediateTables))
+		defer C.free_lua_error(s._l, cResult.err)
+
+		err := LuaErrorToGo(s, cResult.err)
+		if cResult.value != nil {
+			valArray := (*[1 << 30]*C.struct_lua_value)(unsafe.Pointer(&cResult.value))
+			vals := buildGoValues(s, 1, valArray)
+			if len(vals) > 0 {
+				result = vals[0]
+				if valArray[0] != nil {
+					C.free_temporary_lua_value(s._l, valArray[0])
+				}
 			}
 		}
-	}
+		return err
+	})
 
 	return result, err
 }
 
+// GetGlobal reads the value at path, which is made up of dot-separated names and bracketed keys
+// such as `a["x.y"].b[3]['10']`
 func (s *LuaState) GetGlobal(path string) (interface{}, error) {
-	return s.getGlobal(path, false)
+	keys, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.getGlobal(path, keys, false)
+}
+
+// GetGlobalKeys reads the value found by indexing the globals table with each key in turn
+func (s *LuaState) GetGlobalKeys(keys ...interface{}) (interface{}, error) {
+	return s.getGlobal(formatPath(keys), keys, false)
 }
 
 func (s *LuaState) setGlobal(path string, value interface{}, createIntermediateTables bool) error {
+	keys, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+	defer s.rethrowPendingPanic()
+
 	cPath := C.CString(path)
 	defer C.free(unsafe.Pointer(cPath))
 
@@ -77,14 +217,16 @@ func (s *LuaState) setGlobal(path string, value interface{}, createIntermediateT
 	if err != nil {
 		return err
 	}
-	if cValue.temporary == C._Bool(true) {
+	if cValue != nil && cValue.temporary == C._Bool(true) {
 		defer C.free_temporary_lua_value(s._l, cValue)
 	}
 
-	cErr := C.set_global(s._l, cPath, cValue, (C._Bool)(createIntermediateTables))
-	defer C.free_lua_error(cErr)
+	return withPathKeys(s, keys, func(cKeys C.lua_args) error {
+		cErr := C.set_global(s._l, cPath, cKeys, cValue, (C._Bool)(createIntermediateTables))
+		defer C.free_lua_error(s._l, cErr)
 
-	return LuaErrorToGo(cErr)
+		return LuaErrorToGo(s, cErr)
+	})
 }
 
 func (s *LuaState) SetGlobal(path string, value interface{}) error {
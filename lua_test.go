@@ -1,9 +1,18 @@
 package luajitter
 
 import (
+	"bytes"
+	"compress/gzip"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"testing/fstest"
 
 	"github.com/stretchr/testify/require"
 )
@@ -685,3 +694,2086 @@ end
 	fmt.Println(cbCount)
 	fmt.Println(out[0])
 }
+
+func TestStructuredErrors(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.DoString(`this is not lua`)
+	require.NotNil(err)
+	var luaErr *LuaError
+	require.True(errors.As(err, &luaErr))
+	require.Equal(ErrorKindSyntax, luaErr.Kind)
+
+	err = vm.DoString("local x = 1\nerror('boom')")
+	require.NotNil(err)
+	require.True(errors.As(err, &luaErr))
+	require.Equal(ErrorKindRuntime, luaErr.Kind)
+	require.Equal(2, luaErr.Line)
+	require.Contains(luaErr.ChunkName, "[string")
+	require.Contains(luaErr.Traceback, "stack traceback:")
+
+	err = vm.DoString(`function nested() error("deep") end`)
+	require.Nil(err)
+
+	funcObj, err := vm.GetGlobal("nested")
+	require.Nil(err)
+	f := funcObj.(*LocalLuaFunction)
+	_, err = f.Call()
+	require.NotNil(err)
+	require.True(errors.As(err, &luaErr))
+	require.Equal(ErrorKindRuntime, luaErr.Kind)
+	require.Equal(1, luaErr.Line)
+	require.Contains(luaErr.Traceback, "stack traceback:")
+
+	err = f.Close()
+	require.Nil(err)
+}
+
+func TestNonStringErrors(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.DoString(`error({code=42})`)
+	require.NotNil(err)
+	var luaErr *LuaError
+	require.True(errors.As(err, &luaErr))
+	require.Equal("(error object is a table value)", luaErr.Message)
+	require.IsType(map[interface{}]interface{}{}, luaErr.Value)
+	require.Equal(42.0, luaErr.Value.(map[interface{}]interface{})["code"])
+
+	err = vm.DoString(`error(nil)`)
+	require.NotNil(err)
+	require.True(errors.As(err, &luaErr))
+	require.Nil(luaErr.Value)
+
+	err = vm.DoString(`error(setmetatable({}, {__tostring = function() return "custom" end}))`)
+	require.NotNil(err)
+	require.Equal("custom", err.Error())
+
+	err = vm.DoString(`error(5, 0)`)
+	require.NotNil(err)
+	require.True(errors.As(err, &luaErr))
+	require.Equal("5", luaErr.Message)
+	require.Equal(5.0, luaErr.Value)
+
+	//Values that hold a ref are released rather than handed out with nothing to close them
+	err = vm.DoString(`error(function() end)`)
+	require.NotNil(err)
+	require.True(errors.As(err, &luaErr))
+	require.Equal("(error object is a function value)", luaErr.Value)
+
+	err = vm.DoString(`error(coroutine.create(function() end))`)
+	require.NotNil(err)
+	require.True(errors.As(err, &luaErr))
+	require.Equal("(error object is a thread value)", luaErr.Value)
+
+	err = vm.DoString(`
+local err = {handler = function() end}
+err.self = err
+error(err)
+`)
+	require.NotNil(err)
+	require.True(errors.As(err, &luaErr))
+	errTable := luaErr.Value.(map[interface{}]interface{})
+	require.Equal("(function value)", errTable["handler"])
+	require.Equal(reflect.ValueOf(errTable).Pointer(), reflect.ValueOf(errTable["self"]).Pointer())
+
+	err = vm.DoString(`error({[function() end] = "first", [function() end] = "second", [coroutine.create(function() end)] = true})`)
+	require.NotNil(err)
+	require.True(errors.As(err, &luaErr))
+	errTable = luaErr.Value.(map[interface{}]interface{})
+	require.Len(errTable, 3)
+	require.ElementsMatch([]interface{}{"first", "second"}, []interface{}{errTable["(function key)"], errTable["(function key 2)"]})
+	require.Equal(true, errTable["(thread key)"])
+}
+
+var errSentinel = errors.New("sentinel failure")
+
+func SentinelCallback(args []interface{}) ([]interface{}, error) {
+	return nil, fmt.Errorf("wrapped: %w", errSentinel)
+}
+
+func TestGoErrorRoundTrip(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.SetGlobal("failing", SentinelCallback)
+	require.Nil(err)
+
+	err = vm.DoString(`failing()`)
+	require.NotNil(err)
+	require.True(errors.Is(err, errSentinel))
+	require.Equal("wrapped: sentinel failure", err.Error())
+
+	err = vm.DoString(`
+function catchMessage()
+	local ok, err = pcall(failing)
+	return tostring(err)
+end
+function rethrow()
+	local ok, err = pcall(failing)
+	error(err)
+end
+`)
+	require.Nil(err)
+
+	funcObj, err := vm.GetGlobal("catchMessage")
+	require.Nil(err)
+	f := funcObj.(*LocalLuaFunction)
+	out, err := f.Call()
+	require.Nil(err)
+	require.Equal([]interface{}{"wrapped: sentinel failure"}, out)
+	err = f.Close()
+	require.Nil(err)
+
+	funcObj, err = vm.GetGlobal("rethrow")
+	require.Nil(err)
+	f = funcObj.(*LocalLuaFunction)
+	_, err = f.Call()
+	require.True(errors.Is(err, errSentinel))
+	err = f.Close()
+	require.Nil(err)
+
+	//Handlers written for string errors keep working
+	results, err := vm.Eval(`
+local ok, err = pcall(failing)
+return "failed: " .. err, err .. "!", err:match("wrapped: (%a+)"), err:upper(), err:len()
+`)
+	require.Nil(err)
+	require.Equal([]interface{}{"failed: wrapped: sentinel failure", "wrapped: sentinel failure!", "sentinel",
+		"WRAPPED: SENTINEL FAILURE", float64(25)}, results)
+
+	err = vm.DoString(`
+local ok, err = pcall(failing)
+local _ = err .. {}
+`)
+	require.NotNil(err)
+	require.Contains(err.Error(), "attempt to concatenate a table value")
+}
+
+func PanicCallback(args []interface{}) ([]interface{}, error) {
+	panic("callback exploded")
+}
+
+func TestCallbackPanic(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.SetGlobal("explode", PanicCallback)
+	require.Nil(err)
+
+	err = vm.DoString(`explode()`)
+	require.NotNil(err)
+	var panicErr *CallbackPanicError
+	require.True(errors.As(err, &panicErr))
+	require.Equal("callback exploded", panicErr.Value)
+	require.NotEmpty(panicErr.Stack)
+
+	err = vm.DoString(`
+local ok, err = pcall(explode)
+assert(not ok)
+assert(string.find(tostring(err), "callback exploded"))
+`)
+	require.Nil(err)
+}
+
+func TestCallbackRepanic(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState(WithPanicMode(PanicModeRepanic))
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.SetGlobal("explode", PanicCallback)
+	require.Nil(err)
+
+	require.PanicsWithValue("callback exploded", func() {
+		defer func() {
+			r := recover()
+			panic(r.(*CallbackPanicError).Value)
+		}()
+		_ = vm.DoString(`explode()`)
+	})
+}
+
+func TestRepanicFromMetamethods(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState(WithPanicMode(PanicModeRepanic))
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	explode := func(args []interface{}) ([]interface{}, error) {
+		panic("metamethod exploded")
+	}
+	metatable, err := vm.NewMetatable("exploding", map[string]interface{}{
+		"__index":    explode,
+		"__newindex": explode,
+	})
+	require.Nil(err)
+	defer metatable.Close()
+
+	table, err := vm.NewTable()
+	require.Nil(err)
+	defer table.Close()
+	require.Nil(table.SetMetatable(metatable))
+
+	require.Panics(func() { _, _ = table.Get("missing") })
+	require.Panics(func() { _ = table.Set("missing", 1) })
+
+	//The panics were rethrown where they happened, so nothing is left over for the next call
+	require.NotPanics(func() { _ = vm.DoString(`local x = 1`) })
+	_, err = table.RawGet("missing")
+	require.Nil(err)
+}
+
+type panickingMarshaler struct{}
+
+func (p panickingMarshaler) MarshalLua() (interface{}, error) {
+	panic("marshal exploded")
+}
+
+func TestReturnValuePanic(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.SetGlobal("badMarshal", func(args []interface{}) ([]interface{}, error) {
+		return []interface{}{"before", panickingMarshaler{}, "after"}, nil
+	})
+	require.Nil(err)
+
+	results, err := vm.Eval(`
+local ok, err = pcall(badMarshal)
+return ok, tostring(err)
+`)
+	require.Nil(err)
+	require.Equal(false, results[0])
+	require.Contains(results[1], "go callback panicked: marshal exploded")
+
+	err = vm.DoString(`badMarshal()`)
+	require.NotNil(err)
+	var panicErr *CallbackPanicError
+	require.True(errors.As(err, &panicErr))
+	require.Equal("marshal exploded", panicErr.Value)
+}
+
+func TestCallbackReturnErrors(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	table, err := vm.NewTable()
+	require.Nil(err)
+	defer table.Close()
+
+	err = vm.SetGlobal("badReturn", func(args []interface{}) ([]interface{}, error) {
+		return []interface{}{"built", table, make(chan int), map[string]interface{}{"x": 1}}, nil
+	})
+	require.Nil(err)
+
+	results, err := vm.Eval(`
+local ok, err = pcall(badReturn)
+return ok, tostring(err)
+`)
+	require.Nil(err)
+	require.Equal(false, results[0])
+	require.Contains(results[1], "cannot return value 3 to lua")
+
+	//The table handed back is still usable after the failed return
+	err = table.Set("key", "value")
+	require.Nil(err)
+}
+
+func TestReflectedCallbacks(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.SetGlobal("repeatString", func(count int, value string) (string, error) {
+		out := ""
+		for i := 0; i < count; i++ {
+			out += value
+		}
+		return out, nil
+	})
+	require.Nil(err)
+
+	err = vm.SetGlobal("sum", func(values ...float64) float64 {
+		total := 0.0
+		for _, value := range values {
+			total += value
+		}
+		return total
+	})
+	require.Nil(err)
+
+	err = vm.DoString(`
+function reflected()
+	return repeatString(3, "ab"), sum(1, 2, 3.5), sum()
+end
+`)
+	require.Nil(err)
+
+	funcObj, err := vm.GetGlobal("reflected")
+	require.Nil(err)
+	f := funcObj.(*LocalLuaFunction)
+	out, err := f.Call()
+	require.Nil(err)
+	require.Equal([]interface{}{"ababab", 6.5, 0.0}, out)
+	err = f.Close()
+	require.Nil(err)
+
+	err = vm.DoString(`repeatString(2, {})`)
+	require.NotNil(err)
+	require.Equal("bad argument #2 to 'repeatString' (string expected, got table)", err.Error())
+	var argErr *ArgumentError
+	require.True(errors.As(err, &argErr))
+	require.Equal(2, argErr.Index)
+
+	err = vm.DoString(`repeatString(1.5, "a")`)
+	require.NotNil(err)
+	require.Contains(err.Error(), "bad argument #1")
+
+	err = vm.DoString(`repeatString(1)`)
+	require.NotNil(err)
+	require.Contains(err.Error(), "string expected, got no value")
+}
+
+func EachCallback(L *LuaState, args []interface{}) ([]interface{}, error) {
+	table := args[0].(*LocalLuaTable)
+	defer table.Close()
+	fn := args[1].(*LocalLuaFunction)
+	defer fn.Close()
+
+	unrolled, err := table.Unroll()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix, err := L.GetGlobal("prefix")
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range unrolled {
+		_, err = fn.Call(prefix, key, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func TestStatefulCallback(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.SetGlobal("each", EachCallback)
+	require.Nil(err)
+
+	err = vm.SetGlobal("twice", func(L *LuaState, fn *LocalLuaFunction, value float64) (interface{}, error) {
+		defer fn.Close()
+		out, err := fn.Call(value)
+		if err != nil {
+			return nil, err
+		}
+		out, err = fn.Call(out[0])
+		if err != nil {
+			return nil, err
+		}
+		return out[0], nil
+	})
+	require.Nil(err)
+
+	err = vm.DoString(`
+prefix = "key:"
+seen = {}
+each({a=1, b=2}, function(p, k, v) seen[p .. k] = v end)
+assert(seen["key:a"] == 1)
+assert(seen["key:b"] == 2)
+assert(twice(function(x) return x * 3 end, 2) == 18)
+`)
+	require.Nil(err)
+
+	table, err := vm.NewTable()
+	require.Nil(err)
+	err = vm.SetGlobal("fresh", table)
+	require.Nil(err)
+	err = table.Close()
+	require.Nil(err)
+
+	err = vm.DoString(`assert(type(fresh) == "table")`)
+	require.Nil(err)
+}
+
+type dbConfig struct {
+	Host string `lua:"host"`
+	Port uint16 `lua:"port"`
+}
+
+type appConfig struct {
+	Name     string         `lua:"name"`
+	Debug    bool           `lua:"debug"`
+	Ratio    float32        `lua:"ratio"`
+	DB       *dbConfig      `lua:"db"`
+	Replicas []dbConfig     `lua:"replicas"`
+	Limits   map[string]int `lua:"limits"`
+	Ports    map[int]string `lua:"ports"`
+	Extra    interface{}    `lua:"extra"`
+	Skipped  string         `lua:"-"`
+}
+
+func TestDecodeStruct(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.DoString(`
+config = {
+	name = "service",
+	debug = true,
+	ratio = 0.5,
+	db = { host = "localhost", port = 5432 },
+	replicas = {
+		{ host = "a", port = 1 },
+		{ host = "b", port = 2 },
+	},
+	limits = { requests = 10 },
+	ports = { [80] = "http" },
+	extra = "anything",
+	Skipped = "ignored",
+}
+bad = { db = { port = 70000 } }
+`)
+	require.Nil(err)
+
+	var config appConfig
+	err = vm.GetGlobalInto("config", &config)
+	require.Nil(err)
+	require.Equal("service", config.Name)
+	require.True(config.Debug)
+	require.Equal(float32(0.5), config.Ratio)
+	require.Equal(&dbConfig{Host: "localhost", Port: 5432}, config.DB)
+	require.Equal([]dbConfig{{Host: "a", Port: 1}, {Host: "b", Port: 2}}, config.Replicas)
+	require.Equal(map[string]int{"requests": 10}, config.Limits)
+	require.Equal(map[int]string{80: "http"}, config.Ports)
+	require.Equal("anything", config.Extra)
+	require.Equal("", config.Skipped)
+
+	err = vm.GetGlobalInto("config", &config, DecodeStrict())
+	require.NotNil(err)
+	require.Contains(err.Error(), "unknown key 'Skipped'")
+
+	var bad appConfig
+	err = vm.GetGlobalInto("bad", &bad)
+	require.NotNil(err)
+	require.Equal("db.port: number 70000 overflows uint16", err.Error())
+
+	var port int
+	err = vm.GetGlobalInto("config.db.port", &port)
+	require.Nil(err)
+	require.Equal(5432, port)
+
+	tableObj, err := vm.GetGlobal("config.db")
+	require.Nil(err)
+	table := tableObj.(*LocalLuaTable)
+	var db dbConfig
+	err = table.Decode(&db)
+	require.Nil(err)
+	require.Equal("localhost", db.Host)
+	err = table.Close()
+	require.Nil(err)
+}
+
+type decodeHolder struct {
+	Inner interface{} `lua:"inner"`
+}
+
+func TestDecodeKeepsAssignedData(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.DoString(`holder = { inner = { f = function() return "called" end } }`)
+	require.Nil(err)
+
+	var holder decodeHolder
+	err = vm.GetGlobalInto("holder", &holder)
+	require.Nil(err)
+
+	inner := holder.Inner.(map[interface{}]interface{})
+	fn := inner["f"].(*LocalLuaFunction)
+	results, err := fn.Call()
+	require.Nil(err)
+	require.Equal([]interface{}{"called"}, results)
+	require.Nil(fn.Close())
+}
+
+type marshalInner struct {
+	Label string `lua:"label"`
+}
+
+type marshalOuter struct {
+	Name    string                  `lua:"name"`
+	Count   int                     `lua:"count,omitempty"`
+	Tags    []string                `lua:"tags"`
+	Inner   *marshalInner           `lua:"inner"`
+	Lookup  map[string]marshalInner `lua:"lookup"`
+	Hidden  string                  `lua:"-"`
+	Default bool
+}
+
+func TestMarshalStruct(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.SetGlobal("value", marshalOuter{
+		Name:    "outer",
+		Tags:    []string{"a", "b", "c"},
+		Inner:   &marshalInner{Label: "inner"},
+		Lookup:  map[string]marshalInner{"key": {Label: "looked up"}},
+		Hidden:  "hidden",
+		Default: true,
+	})
+	require.Nil(err)
+
+	err = vm.DoString(`
+assert(value.name == "outer")
+assert(value.count == nil)
+assert(#value.tags == 3)
+assert(value.tags[1] == "a" and value.tags[3] == "c")
+assert(value.inner.label == "inner")
+assert(value.lookup.key.label == "looked up")
+assert(value.Hidden == nil)
+assert(value.Default == true)
+`)
+	require.Nil(err)
+
+	var roundTrip marshalOuter
+	err = vm.GetGlobalInto("value", &roundTrip)
+	require.Nil(err)
+	require.Equal("outer", roundTrip.Name)
+	require.Equal([]string{"a", "b", "c"}, roundTrip.Tags)
+	require.Equal("inner", roundTrip.Inner.Label)
+
+	err = vm.SetGlobal("bad", struct{ C chan int }{})
+	require.NotNil(err)
+}
+
+type marshalTreeNode struct {
+	Name     string             `lua:"name"`
+	Parent   *marshalTreeNode   `lua:"parent,omitempty"`
+	Children []*marshalTreeNode `lua:"children,omitempty"`
+}
+
+func TestMarshalCycles(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	root := &marshalTreeNode{Name: "root"}
+	child := &marshalTreeNode{Name: "child", Parent: root}
+	root.Children = []*marshalTreeNode{child}
+
+	err := vm.SetGlobal("tree", root)
+	require.NotNil(err)
+	require.Contains(err.Error(), "cyclic value")
+
+	selfMap := map[string]interface{}{}
+	selfMap["self"] = selfMap
+	err = vm.SetGlobal("tree", selfMap)
+	require.NotNil(err)
+	require.Contains(err.Error(), "cyclic value")
+
+	anyMap := map[interface{}]interface{}{}
+	anyMap["self"] = anyMap
+	err = vm.SetGlobal("tree", anyMap)
+	require.NotNil(err)
+	require.Contains(err.Error(), "cyclic value")
+
+	//The same pointer showing up twice without containing itself is not a cycle
+	shared := &marshalTreeNode{Name: "shared"}
+	err = vm.SetGlobal("tree", []*marshalTreeNode{shared, shared})
+	require.Nil(err)
+	err = vm.DoString(`assert(tree[1].name == "shared" and tree[2].name == "shared")`)
+	require.Nil(err)
+}
+
+func TestMarshalInvalidKeys(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	var nilPointer *marshalInner
+	for _, invalid := range []interface{}{
+		map[float64]int{math.NaN(): 1},
+		map[*marshalInner]int{nilPointer: 1},
+		map[interface{}]interface{}{Proxy{}: 1},
+		map[string]interface{}{"nested": map[float32]bool{float32(math.NaN()): true}},
+	} {
+		err := vm.SetGlobal("invalid", invalid)
+		require.NotNil(err)
+	}
+
+	fn, err := vm.LoadString("return ...", "")
+	require.Nil(err)
+	defer fn.Close()
+	_, err = fn.Call(map[float64]int{math.NaN(): 1})
+	require.NotNil(err)
+
+	//The state is still usable
+	err = vm.SetGlobal("valid", map[float64]int{1.5: 1})
+	require.Nil(err)
+	err = vm.DoString(`assert(valid[1.5] == 1)`)
+	require.Nil(err)
+}
+
+func TestUnrollSlice(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.DoString(`
+list = { "a", "b", { 1, 2 }, { x = 1 } }
+mixed = { "a", "b", x = 1 }
+holes = { [1] = "a", [3] = "c" }
+fractional = { [1] = "a", [1.5] = "b" }
+empty = {}
+`)
+	require.Nil(err)
+
+	tableObj, err := vm.GetGlobal("list")
+	require.Nil(err)
+	table := tableObj.(*LocalLuaTable)
+	list, err := table.UnrollSlice()
+	require.Nil(err)
+	require.Equal([]interface{}{
+		"a",
+		"b",
+		[]interface{}{1.0, 2.0},
+		map[interface{}]interface{}{"x": 1.0},
+	}, list)
+	err = table.Close()
+	require.Nil(err)
+
+	for _, name := range []string{"mixed", "holes", "fractional"} {
+		tableObj, err = vm.GetGlobal(name)
+		require.Nil(err)
+		table = tableObj.(*LocalLuaTable)
+		_, err = table.UnrollSlice()
+		require.NotNil(err)
+		require.Contains(err.Error(), "not a sequence")
+		err = table.Close()
+		require.Nil(err)
+	}
+
+	tableObj, err = vm.GetGlobal("empty")
+	require.Nil(err)
+	table = tableObj.(*LocalLuaTable)
+	list, err = table.UnrollSlice()
+	require.Nil(err)
+	require.Len(list, 0)
+	err = table.Close()
+	require.Nil(err)
+}
+
+func TestUnrollCycles(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.DoString(`
+cyclic = { name = "root" }
+cyclic.self = cyclic
+cyclic.child = { parent = cyclic }
+cyclic.shared = { 1 }
+cyclic.alsoShared = cyclic.shared
+
+deep = {}
+local current = deep
+for i = 1, 10 do
+	current.next = {}
+	current = current.next
+end
+`)
+	require.Nil(err)
+
+	tableObj, err := vm.GetGlobal("cyclic")
+	require.Nil(err)
+	table := tableObj.(*LocalLuaTable)
+	unrolled, err := table.Unroll()
+	require.Nil(err)
+	require.Equal("root", unrolled["name"])
+	self := unrolled["self"].(map[interface{}]interface{})
+	require.Equal(reflect.ValueOf(unrolled).Pointer(), reflect.ValueOf(self).Pointer())
+	child := unrolled["child"].(map[interface{}]interface{})
+	parent := child["parent"].(map[interface{}]interface{})
+	require.Equal(reflect.ValueOf(unrolled).Pointer(), reflect.ValueOf(parent).Pointer())
+	shared := unrolled["shared"].(map[interface{}]interface{})
+	alsoShared := unrolled["alsoShared"].(map[interface{}]interface{})
+	require.Equal(reflect.ValueOf(shared).Pointer(), reflect.ValueOf(alsoShared).Pointer())
+	err = table.Close()
+	require.Nil(err)
+
+	tableObj, err = vm.GetGlobal("deep")
+	require.Nil(err)
+	table = tableObj.(*LocalLuaTable)
+	_, err = table.Unroll(UnrollMaxDepth(5))
+	require.NotNil(err)
+	require.Contains(err.Error(), "maximum unroll depth")
+	_, err = table.Unroll(UnrollMaxDepth(0))
+	require.Nil(err)
+	_, err = table.Unroll()
+	require.Nil(err)
+	err = table.Close()
+	require.Nil(err)
+}
+
+func TestBinaryStrings(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.DoString(`
+binary = "a\0b\0c"
+binaryTable = { ["k\0ey"] = "v\0alue" }
+function length(s) return #s end
+`)
+	require.Nil(err)
+
+	value, err := vm.GetGlobal("binary")
+	require.Nil(err)
+	require.Equal("a\x00b\x00c", value)
+
+	tableObj, err := vm.GetGlobal("binaryTable")
+	require.Nil(err)
+	table := tableObj.(*LocalLuaTable)
+	unrolled, err := table.Unroll()
+	require.Nil(err)
+	require.Equal(map[interface{}]interface{}{"k\x00ey": "v\x00alue"}, unrolled)
+	err = table.Close()
+	require.Nil(err)
+
+	err = vm.SetGlobal("fromGo", []byte{0, 1, 2, 0})
+	require.Nil(err)
+	value, err = vm.GetGlobal("fromGo")
+	require.Nil(err)
+	require.Equal("\x00\x01\x02\x00", value)
+
+	fnObj, err := vm.GetGlobal("length")
+	require.Nil(err)
+	fn := fnObj.(*LocalLuaFunction)
+	results, err := fn.Call("x\x00y")
+	require.Nil(err)
+	require.Equal([]interface{}{3.0}, results)
+	err = fn.Close()
+	require.Nil(err)
+
+	var payload struct {
+		Data []byte `lua:"data"`
+	}
+	err = vm.DoString(`payload = { data = "\1\0\2" }`)
+	require.Nil(err)
+	err = vm.GetGlobalInto("payload", &payload)
+	require.Nil(err)
+	require.Equal([]byte{1, 0, 2}, payload.Data)
+}
+
+func TestStringsAsBytes(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState(WithStringsAsBytes())
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.DoString(`
+binary = "a\0b"
+keyed = { name = "value" }
+`)
+	require.Nil(err)
+
+	value, err := vm.GetGlobal("binary")
+	require.Nil(err)
+	require.Equal([]byte("a\x00b"), value)
+
+	tableObj, err := vm.GetGlobal("keyed")
+	require.Nil(err)
+	table := tableObj.(*LocalLuaTable)
+	unrolled, err := table.Unroll()
+	require.Nil(err)
+	require.Equal(map[interface{}]interface{}{"name": []byte("value")}, unrolled)
+	err = table.Close()
+	require.Nil(err)
+
+	var name string
+	err = vm.GetGlobalInto("keyed.name", &name)
+	require.Nil(err)
+	require.Equal("value", name)
+}
+
+func TestInt64Cdata(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState(WithInt64Cdata())
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.SetGlobal("big", int64(1<<62+1))
+	require.Nil(err)
+	err = vm.SetGlobal("negative", int64(-1<<62-1))
+	require.Nil(err)
+	err = vm.SetGlobal("unsigned", uint64(1<<64-1))
+	require.Nil(err)
+
+	err = vm.DoString(`
+assert(type(big) == "cdata")
+assert(big == 4611686018427387905LL)
+assert(negative == -4611686018427387905LL)
+assert(unsigned == 18446744073709551615ULL)
+fromLua = 9007199254740993LL
+fromLuaUnsigned = 5ULL
+`)
+	require.Nil(err)
+
+	for name, expected := range map[string]interface{}{
+		"big":             int64(1<<62 + 1),
+		"negative":        int64(-1<<62 - 1),
+		"unsigned":        uint64(1<<64 - 1),
+		"fromLua":         int64(9007199254740993),
+		"fromLuaUnsigned": uint64(5),
+	} {
+		value, err := vm.GetGlobal(name)
+		require.Nil(err)
+		require.Equal(expected, value, name)
+	}
+
+	var id uint32
+	err = vm.GetGlobalInto("fromLuaUnsigned", &id)
+	require.Nil(err)
+	require.Equal(uint32(5), id)
+
+	err = vm.GetGlobalInto("big", &id)
+	require.NotNil(err)
+	require.Contains(err.Error(), "overflows")
+}
+
+func TestInt64CdataKeys(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState(WithInt64Cdata())
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.SetGlobal("t", map[int64]string{5: "x"})
+	require.Nil(err)
+	err = vm.DoString(`assert(t[5] == "x")`)
+	require.Nil(err)
+
+	tableObj, err := vm.GetGlobal("t")
+	require.Nil(err)
+	table := tableObj.(*LocalLuaTable)
+	defer table.Close()
+
+	value, err := table.Get(int64(5))
+	require.Nil(err)
+	require.Equal("x", value)
+
+	err = table.Set(uint64(6), "y")
+	require.Nil(err)
+	err = vm.DoString(`assert(t[6] == "y")`)
+	require.Nil(err)
+
+	value, err = vm.GetGlobal("t[6]")
+	require.Nil(err)
+	require.Equal("y", value)
+
+	//Values are still boxed
+	err = table.Set("big", int64(1<<62+1))
+	require.Nil(err)
+	err = vm.DoString(`assert(t.big == 4611686018427387905LL)`)
+	require.Nil(err)
+
+	err = table.Set(int64(1<<62+1), "inexact")
+	require.NotNil(err)
+	err = vm.SetGlobal("inexact", map[uint64]bool{1<<64 - 1: true})
+	require.NotNil(err)
+}
+
+func TestIntegersAsInt64(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState(WithIntegersAsInt64())
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.DoString(`
+integral = 5
+fractional = 1.5
+list = { 10, 20 }
+`)
+	require.Nil(err)
+
+	value, err := vm.GetGlobal("integral")
+	require.Nil(err)
+	require.Equal(int64(5), value)
+
+	value, err = vm.GetGlobal("fractional")
+	require.Nil(err)
+	require.Equal(1.5, value)
+
+	var list []int
+	err = vm.GetGlobalInto("list", &list)
+	require.Nil(err)
+	require.Equal([]int{10, 20}, list)
+}
+
+func TestTableAccessors(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.DoString(`
+plain = { "a", "b", "c", name = "plain" }
+writes = {}
+proxied = setmetatable({}, {
+	__index = function(t, k) return "default " .. k end,
+	__newindex = function(t, k, v) writes[k] = v end,
+})
+broken = setmetatable({}, { __index = function() error("no reads") end })
+guarded = setmetatable({ kept = 1 }, { __newindex = function() error("no writes") end })
+`)
+	require.Nil(err)
+
+	tableObj, err := vm.GetGlobal("plain")
+	require.Nil(err)
+	table := tableObj.(*LocalLuaTable)
+
+	value, err := table.Get("name")
+	require.Nil(err)
+	require.Equal("plain", value)
+	value, err = table.Get(2)
+	require.Nil(err)
+	require.Equal("b", value)
+	value, err = table.Get("missing")
+	require.Nil(err)
+	require.Nil(value)
+	require.Equal(3, table.Len())
+
+	err = table.Set(4, "d")
+	require.Nil(err)
+	require.Equal(4, table.Len())
+	err = table.Delete("name")
+	require.Nil(err)
+	value, err = table.Get("name")
+	require.Nil(err)
+	require.Nil(value)
+
+	err = table.Set(nil, "value")
+	require.NotNil(err)
+	err = table.Close()
+	require.Nil(err)
+
+	tableObj, err = vm.GetGlobal("proxied")
+	require.Nil(err)
+	table = tableObj.(*LocalLuaTable)
+
+	value, err = table.Get("key")
+	require.Nil(err)
+	require.Equal("default key", value)
+	value, err = table.RawGet("key")
+	require.Nil(err)
+	require.Nil(value)
+
+	err = table.Set("written", 5)
+	require.Nil(err)
+	value, err = table.RawGet("written")
+	require.Nil(err)
+	require.Nil(value)
+	value, err = vm.GetGlobal("writes.written")
+	require.Nil(err)
+	require.Equal(5.0, value)
+
+	err = table.RawSet("written", 6)
+	require.Nil(err)
+	value, err = table.Get("written")
+	require.Nil(err)
+	require.Equal(6.0, value)
+	err = table.Close()
+	require.Nil(err)
+
+	tableObj, err = vm.GetGlobal("broken")
+	require.Nil(err)
+	table = tableObj.(*LocalLuaTable)
+	_, err = table.Get("anything")
+	require.NotNil(err)
+	require.Contains(err.Error(), "no reads")
+	err = table.Close()
+	require.Nil(err)
+
+	tableObj, err = vm.GetGlobal("guarded")
+	require.Nil(err)
+	table = tableObj.(*LocalLuaTable)
+	err = table.Set("absent", 1)
+	require.NotNil(err)
+	require.Contains(err.Error(), "no writes")
+	err = table.Delete("kept")
+	require.Nil(err)
+	err = table.Delete("absent")
+	require.Nil(err)
+	value, err = table.RawGet("kept")
+	require.Nil(err)
+	require.Nil(value)
+	err = table.Close()
+	require.Nil(err)
+}
+
+func TestTablePaths(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.DoString(`
+module = { config = { db = { host = "localhost" } }, list = { "first" } }
+`)
+	require.Nil(err)
+
+	tableObj, err := vm.GetGlobal("module")
+	require.Nil(err)
+	table := tableObj.(*LocalLuaTable)
+	defer table.Close()
+
+	value, err := table.GetPath("config.db.host")
+	require.Nil(err)
+	require.Equal("localhost", value)
+	value, err = table.GetPath("list.1")
+	require.Nil(err)
+	require.Equal("first", value)
+
+	err = table.SetPath("config.db.port", 5432)
+	require.Nil(err)
+	value, err = vm.GetGlobal("module.config.db.port")
+	require.Nil(err)
+	require.Equal(5432.0, value)
+
+	err = table.SetPath("missing.value", 1)
+	require.NotNil(err)
+	err = table.InitPath("created.inner.value", "made")
+	require.Nil(err)
+	value, err = vm.GetGlobal("module.created.inner.value")
+	require.Nil(err)
+	require.Equal("made", value)
+
+	value, err = vm.GetGlobal("config")
+	require.Nil(err)
+	require.Nil(value)
+}
+
+func TestProtectedPaths(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	metatable, err := vm.NewMetatable("guarded", map[string]interface{}{
+		"__newindex": func(args []interface{}) ([]interface{}, error) {
+			return nil, errors.New("table is read-only")
+		},
+	})
+	require.Nil(err)
+	defer metatable.Close()
+
+	err = vm.DoString(`
+guarded = { inner = setmetatable({}, { __index = function(t, k) error("no field " .. k) end }) }
+`)
+	require.Nil(err)
+	tableObj, err := vm.GetGlobal("guarded")
+	require.Nil(err)
+	table := tableObj.(*LocalLuaTable)
+	defer table.Close()
+
+	inner, err := table.GetPath("inner")
+	require.Nil(err)
+	require.Nil(inner.(*LocalLuaTable).SetMetatable(metatable))
+	require.Nil(inner.(*LocalLuaTable).Close())
+
+	_, err = table.GetPath("inner.missing")
+	require.NotNil(err)
+	require.IsType(&LuaError{}, err)
+	require.Contains(err.Error(), "no field missing")
+
+	err = table.SetPath("inner.value", 1)
+	require.NotNil(err)
+	require.Contains(err.Error(), "table is read-only")
+
+	err = table.InitPath("inner.value.deeper", 1)
+	require.NotNil(err)
+
+	//Strict globals raise from __index on _G itself
+	err = vm.DoString(`setmetatable(_G, { __index = function(t, k) error("undefined global " .. k) end })`)
+	require.Nil(err)
+	_, err = vm.GetGlobal("undefinedGlobal.field")
+	require.NotNil(err)
+	require.Contains(err.Error(), "undefined global undefinedGlobal")
+
+	value, err := vm.GetGlobal("guarded.inner")
+	require.Nil(err)
+	require.Nil(value.(LocalData).Close())
+}
+
+func TestPathSyntax(t *testing.T) {
+	require := require.New(t)
+
+	keys, err := parsePath(`a["x.y"].b[3]['10'][true][-1.5].c\d`)
+	require.Nil(err)
+	require.Equal([]interface{}{"a", "x.y", "b", 3.0, "10", true, -1.5, `c\d`}, keys)
+
+	keys, err = parsePath(`list.2["quote\"d"]`)
+	require.Nil(err)
+	require.Equal([]interface{}{"list", 2, `quote"d`}, keys)
+
+	keys, err = parsePath(`a["tab\there"]['\65\066\x43\u{e9}\z   d']["\\\n"]`)
+	require.Nil(err)
+	require.Equal([]interface{}{"a", "tab\there", "ABC\u00e9d", "\\\n"}, keys)
+
+	for _, invalid := range []string{"", "a..b", "a.", "a[", "a[1", `a["x]`, "a[nope]", "a[1]b", "a[nan]", "a[NaN]",
+		`a["\256"]`, `a["\q"]`, `a["\x4"]`, `a["\u{zz}"]`} {
+		_, err = parsePath(invalid)
+		require.NotNil(err, invalid)
+	}
+}
+
+func TestBracketedPaths(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.DoString(`
+a = { ["x.y"] = { b = { "first", "second", "third" } }, ["10"] = "string ten", [10] = "number ten", [true] = "yes" }
+`)
+	require.Nil(err)
+
+	value, err := vm.GetGlobal(`a["x.y"].b[3]`)
+	require.Nil(err)
+	require.Equal("third", value)
+
+	value, err = vm.GetGlobal(`a['10']`)
+	require.Nil(err)
+	require.Equal("string ten", value)
+
+	value, err = vm.GetGlobal(`a.10`)
+	require.Nil(err)
+	require.Equal("number ten", value)
+
+	value, err = vm.GetGlobal(`a[true]`)
+	require.Nil(err)
+	require.Equal("yes", value)
+
+	value, err = vm.GetGlobalKeys("a", "x.y", "b", 2)
+	require.Nil(err)
+	require.Equal("second", value)
+
+	err = vm.SetGlobal(`a["x.y"]["new.key"]`, "set")
+	require.Nil(err)
+	value, err = vm.GetGlobalKeys("a", "x.y", "new.key")
+	require.Nil(err)
+	require.Equal("set", value)
+
+	_, err = vm.GetGlobalKeys("a", "missing", "b")
+	require.NotNil(err)
+	require.Contains(err.Error(), "missing")
+
+	_, err = vm.GetGlobalKeys("a", nil)
+	require.NotNil(err)
+	_, err = vm.GetGlobalKeys("a", math.NaN())
+	require.NotNil(err)
+	err = vm.InitGlobal("a[nan]", 1)
+	require.NotNil(err)
+}
+
+func TestTableIteration(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.DoString(`
+mixed = { "a", "b", "c", x = 1, y = 2, [{}] = "table key" }
+holes = { "a", "b", nil, "d" }
+`)
+	require.Nil(err)
+
+	tableObj, err := vm.GetGlobal("mixed")
+	require.Nil(err)
+	table := tableObj.(*LocalLuaTable)
+	defer table.Close()
+
+	seen := make(map[interface{}]interface{})
+	tableKeys := 0
+	err = table.ForEach(func(key interface{}, value interface{}) bool {
+		if keyTable, isTable := key.(*LocalLuaTable); isTable {
+			tableKeys++
+			require.Equal("table key", value)
+			keyTable.Close()
+			return true
+		}
+		seen[key] = value
+		return true
+	})
+	require.Nil(err)
+	require.Equal(1, tableKeys)
+	require.Equal(map[interface{}]interface{}{1.0: "a", 2.0: "b", 3.0: "c", "x": 1.0, "y": 2.0}, seen)
+
+	visited := 0
+	err = table.ForEach(func(key interface{}, value interface{}) bool {
+		if localData, isLocal := key.(LocalData); isLocal {
+			localData.Close()
+		}
+		visited++
+		return visited < 2
+	})
+	require.Nil(err)
+	require.Equal(2, visited)
+
+	var array []interface{}
+	err = table.ForEachArray(func(index int, value interface{}) bool {
+		require.Equal(len(array)+1, index)
+		array = append(array, value)
+		return true
+	})
+	require.Nil(err)
+	require.Equal([]interface{}{"a", "b", "c"}, array)
+
+	tableObj, err = vm.GetGlobal("holes")
+	require.Nil(err)
+	holes := tableObj.(*LocalLuaTable)
+	defer holes.Close()
+
+	array = nil
+	err = holes.ForEachArray(func(index int, value interface{}) bool {
+		array = append(array, value)
+		return true
+	})
+	require.Nil(err)
+	require.Equal([]interface{}{"a", "b"}, array)
+}
+
+func TestIterationKeyIdentity(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState(WithInt64Cdata())
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	//Keys that can't be pushed back as the same value they were read as
+	err := vm.DoString(`
+keyed = { [print] = "c function", [string.len] = "another", [1LL] = "int64", [2ULL] = "uint64", plain = "string" }
+`)
+	require.Nil(err)
+	tableObj, err := vm.GetGlobal("keyed")
+	require.Nil(err)
+	table := tableObj.(*LocalLuaTable)
+	defer table.Close()
+
+	var values []string
+	err = table.ForEach(func(key interface{}, value interface{}) bool {
+		if localData, isLocal := key.(LocalData); isLocal {
+			localData.Close()
+		}
+		values = append(values, value.(string))
+		return true
+	})
+	require.Nil(err)
+	require.ElementsMatch([]string{"c function", "another", "int64", "uint64", "string"}, values)
+}
+
+func TestGoFunctionRoundTrip(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.SetGlobal("double", GoFunction{Func: func(value float64) float64 { return value * 2 }})
+	require.Nil(err)
+
+	//The function is followed by another argument, which must not be shifted out of place
+	err = vm.SetGlobal("apply", func(fn *LocalLuaFunction, value float64, label string) (interface{}, string, error) {
+		defer fn.Close()
+		results, err := fn.Call(value)
+		if err != nil {
+			return nil, "", err
+		}
+		return results[0], label, nil
+	})
+	require.Nil(err)
+
+	results, err := vm.Eval(`return apply(double, 21, "label")`)
+	require.Nil(err)
+	require.Equal([]interface{}{float64(42), "label"}, results)
+
+	results, err = vm.Eval(`return double, "after"`)
+	require.Nil(err)
+	require.Len(results, 2)
+	require.Equal("after", results[1])
+	fn := results[0].(*LocalLuaFunction)
+	results, err = fn.Call(4)
+	require.Nil(err)
+	require.Equal([]interface{}{float64(8)}, results)
+	require.Nil(fn.Close())
+}
+
+func TestMetatables(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	metatable, err := vm.NewMetatable("Vector", map[string]interface{}{
+		"__index": func(self *LocalLuaTable, key string) string {
+			defer self.Close()
+			return "missing " + key
+		},
+		"__newindex": func(self *LocalLuaTable, key string, value float64) error {
+			defer self.Close()
+			return self.RawSet(key, value*2)
+		},
+		"__call": func(self *LocalLuaTable, value float64) float64 {
+			defer self.Close()
+			return value + 1
+		},
+		"__tostring": func(self *LocalLuaTable) string {
+			defer self.Close()
+			return "vector"
+		},
+		"__eq": func(lhs *LocalLuaTable, rhs *LocalLuaTable) bool {
+			lhs.Close()
+			rhs.Close()
+			return true
+		},
+		"__lt": func(lhs *LocalLuaTable, rhs *LocalLuaTable) (bool, error) {
+			defer lhs.Close()
+			defer rhs.Close()
+			lValue, err := lhs.RawGet("x")
+			if err != nil {
+				return false, err
+			}
+			rValue, err := rhs.RawGet("x")
+			if err != nil {
+				return false, err
+			}
+			return lValue.(float64) < rValue.(float64), nil
+		},
+		"name": "Vector",
+	})
+	require.Nil(err)
+	defer metatable.Close()
+
+	table, err := vm.NewTable()
+	require.Nil(err)
+	defer table.Close()
+
+	existing, err := table.GetMetatable()
+	require.Nil(err)
+	require.Nil(existing)
+
+	err = table.SetMetatable(metatable)
+	require.Nil(err)
+	err = vm.SetGlobal("vector", table)
+	require.Nil(err)
+
+	err = vm.DoString(`
+assert(type(getmetatable(vector).__index) == "function")
+assert(getmetatable(vector) == debug.getregistry().Vector)
+assert(vector.anything == "missing anything")
+vector.x = 2
+assert(rawget(vector, "x") == 4)
+assert(vector(1) == 2)
+assert(tostring(vector) == "vector")
+other = setmetatable({ x = 10 }, getmetatable(vector))
+assert(vector == other)
+assert(vector < other)
+assert(not (other < vector))
+`)
+	require.Nil(err)
+
+	fetched, err := table.GetMetatable()
+	require.Nil(err)
+	name, err := fetched.RawGet("name")
+	require.Nil(err)
+	require.Equal("Vector", name)
+	err = fetched.Close()
+	require.Nil(err)
+
+	err = table.SetMetatable(nil)
+	require.Nil(err)
+	err = vm.DoString(`assert(getmetatable(vector) == nil)`)
+	require.Nil(err)
+
+	err = vm.DoString(`function plainFunction() end`)
+	require.Nil(err)
+	fnObj, err := vm.GetGlobal("plainFunction")
+	require.Nil(err)
+	fn := fnObj.(*LocalLuaFunction)
+	err = fn.SetMetatable(metatable)
+	require.NotNil(err)
+	err = fn.Close()
+	require.Nil(err)
+}
+
+type proxyPosition struct {
+	X float64
+	Y float64
+}
+
+type proxyPlayer struct {
+	Name     string
+	Health   int
+	Position proxyPosition
+	Tags     []string `lua:"tags"`
+	secret   string
+}
+
+func (p *proxyPlayer) TakeDamage(amount int) int {
+	p.Health -= amount
+	return p.Health
+}
+
+func (p *proxyPlayer) String() string {
+	return "player " + p.Name
+}
+
+func (p *proxyPlayer) Greet(state *LuaState, greeting string) (string, error) {
+	if state == nil {
+		return "", errors.New("missing state")
+	}
+	return greeting + " " + p.Name, nil
+}
+
+func TestProxy(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	player := &proxyPlayer{Name: "hero", Health: 100, secret: "hidden"}
+	err := vm.SetGlobal("player", Proxy{Value: player})
+	require.Nil(err)
+	err = vm.SetGlobal("samePlayer", Proxy{Value: player})
+	require.Nil(err)
+
+	err = vm.DoString(`
+assert(type(player) == "userdata")
+assert(player.Name == "hero")
+assert(player:TakeDamage(10) == 90)
+assert(player:Greet("hello") == "hello hero")
+player.Health = player.Health - 5
+player.Position.X = 3
+player.tags = { "brave", "tall" }
+assert(player.secret == nil)
+assert(tostring(player) == "player hero")
+assert(player == samePlayer)
+ok, err = pcall(function() player.Unknown = 1 end)
+assert(not ok)
+ok, err = pcall(function() player.Health = "lots" end)
+assert(not ok)
+function identity(value) return value end
+`)
+	require.Nil(err)
+
+	require.Equal(85, player.Health)
+	require.Equal(3.0, player.Position.X)
+	require.Equal([]string{"brave", "tall"}, player.Tags)
+
+	value, err := vm.GetGlobal("player")
+	require.Nil(err)
+	require.True(value == player)
+
+	fnObj, err := vm.GetGlobal("identity")
+	require.Nil(err)
+	fn := fnObj.(*LocalLuaFunction)
+	results, err := fn.Call(Proxy{Value: player})
+	require.Nil(err)
+	require.Len(results, 1)
+	require.True(results[0] == player)
+	err = fn.Close()
+	require.Nil(err)
+
+	err = vm.SetGlobal("heal", func(p *proxyPlayer, amount int) {
+		p.Health += amount
+	})
+	require.Nil(err)
+	err = vm.DoString(`heal(player, 15)`)
+	require.Nil(err)
+	require.Equal(100, player.Health)
+}
+
+type registeredVector struct {
+	X, Y float64
+}
+
+func TestRegisterType(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.RegisterType(&registeredVector{}, TypeDefinition{
+		Name: "geometry.Vector",
+		Constructor: func(x, y float64) *registeredVector {
+			return &registeredVector{X: x, Y: y}
+		},
+		Methods: map[string]interface{}{
+			"Length": func(v *registeredVector) float64 {
+				return v.X*v.X + v.Y*v.Y
+			},
+		},
+		Properties: map[string]Property{
+			"x": {
+				Get: func(v *registeredVector) float64 { return v.X },
+				Set: func(v *registeredVector, x float64) { v.X = x },
+			},
+			"y": {
+				Get: func(v *registeredVector) float64 { return v.Y },
+			},
+		},
+		Metamethods: map[string]interface{}{
+			"__add": func(lhs *registeredVector, rhs *registeredVector) *registeredVector {
+				return &registeredVector{X: lhs.X + rhs.X, Y: lhs.Y + rhs.Y}
+			},
+			"__len": func(v *registeredVector, _ interface{}) int {
+				return 2
+			},
+			"__concat": func(lhs interface{}, rhs interface{}) string {
+				return fmt.Sprint(lhs) + fmt.Sprint(rhs)
+			},
+			"__tostring": func(v *registeredVector) string {
+				return fmt.Sprintf("(%v, %v)", v.X, v.Y)
+			},
+		},
+	})
+	require.Nil(err)
+
+	err = vm.RegisterType(&registeredVector{}, TypeDefinition{Name: "Again"})
+	require.NotNil(err)
+
+	err = vm.DoString(`
+local Vector = geometry.Vector
+a = Vector.new(1, 2)
+b = Vector.new(3, 4)
+sum = a + b
+assert(sum.x == 4 and sum.y == 6)
+assert(b:Length() == 25)
+assert(#a == 2)
+assert(tostring(a) == "(1, 2)")
+assert(a == a)
+a.x = 10
+assert(a.x == 10)
+ok, err = pcall(function() a.y = 5 end)
+assert(not ok)
+assert(string.find(err, "cannot assign to 'y' on geometry.Vector"))
+`)
+	require.Nil(err)
+
+	value, err := vm.GetGlobal("sum")
+	require.Nil(err)
+	require.Equal(&registeredVector{X: 4, Y: 6}, value)
+
+	vector := &registeredVector{X: 7}
+	err = vm.SetGlobal("fromGo", vector)
+	require.Nil(err)
+	err = vm.DoString(`assert(fromGo.x == 7); fromGo.x = 8`)
+	require.Nil(err)
+	require.Equal(8.0, vector.X)
+
+	value, err = vm.GetGlobal("fromGo")
+	require.Nil(err)
+	require.True(value == vector)
+}
+
+type testMoney struct {
+	Cents    int64
+	Currency string
+}
+
+func (m testMoney) MarshalLua() (interface{}, error) {
+	return fmt.Sprintf("%d.%02d %s", m.Cents/100, m.Cents%100, m.Currency), nil
+}
+
+func (m *testMoney) UnmarshalLua(value interface{}) error {
+	text, isString := value.(string)
+	if !isString {
+		return errors.New("money must be a string")
+	}
+
+	var whole, fraction int64
+	_, err := fmt.Sscanf(text, "%d.%d %s", &whole, &fraction, &m.Currency)
+	if err != nil {
+		return err
+	}
+	m.Cents = whole*100 + fraction
+	return nil
+}
+
+type testVector struct {
+	X, Y float64
+}
+
+func (v *testVector) MarshalLua() (interface{}, error) {
+	return []float64{v.X, v.Y}, nil
+}
+
+type failingMarshaler struct{}
+
+func (f failingMarshaler) MarshalLua() (interface{}, error) {
+	return nil, errors.New("cannot marshal")
+}
+
+func TestLuaMarshaler(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.SetGlobal("price", testMoney{Cents: 1234, Currency: "USD"})
+	require.Nil(err)
+	err = vm.SetGlobal("vector", &testVector{X: 1, Y: 2})
+	require.Nil(err)
+	err = vm.SetGlobal("order", struct {
+		Total testMoney `lua:"total"`
+	}{testMoney{Cents: 500, Currency: "EUR"}})
+	require.Nil(err)
+
+	err = vm.DoString(`
+assert(price == "12.34 USD")
+assert(vector[1] == 1 and vector[2] == 2)
+assert(order.total == "5.00 EUR")
+refund = { amount = "3.50 GBP" }
+`)
+	require.Nil(err)
+
+	err = vm.SetGlobal("broken", failingMarshaler{})
+	require.NotNil(err)
+	require.Contains(err.Error(), "cannot marshal")
+
+	var refund struct {
+		Amount testMoney `lua:"amount"`
+	}
+	err = vm.GetGlobalInto("refund", &refund)
+	require.Nil(err)
+	require.Equal(testMoney{Cents: 350, Currency: "GBP"}, refund.Amount)
+
+	var price *testMoney
+	err = vm.GetGlobalInto("price", &price)
+	require.Nil(err)
+	require.Equal(&testMoney{Cents: 1234, Currency: "USD"}, price)
+
+	err = vm.GetGlobalInto("vector", &price)
+	require.NotNil(err)
+	require.Contains(err.Error(), "money must be a string")
+}
+
+func TestLoadString(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	fn, err := vm.LoadString(`
+counter = (counter or 0) + 1
+return counter, ...
+`, "counter.lua")
+	require.Nil(err)
+
+	value, err := vm.GetGlobal("counter")
+	require.Nil(err)
+	require.Nil(value)
+
+	for i := 1; i <= 3; i++ {
+		results, err := fn.Call("arg")
+		require.Nil(err)
+		require.Equal([]interface{}{float64(i), "arg"}, results)
+	}
+	err = fn.Close()
+	require.Nil(err)
+
+	_, err = vm.LoadString("\nlocal x = = 1", "broken.lua")
+	require.NotNil(err)
+	luaErr, isLuaErr := err.(*LuaError)
+	require.True(isLuaErr)
+	require.Equal(ErrorKindSyntax, luaErr.Kind)
+	require.Equal("broken.lua", luaErr.ChunkName)
+	require.Equal(2, luaErr.Line)
+
+	_, err = vm.LoadString("local x = = 1", "=custom")
+	require.NotNil(err)
+	require.Equal("custom", err.(*LuaError).ChunkName)
+}
+
+func TestLoadFile(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	file, err := ioutil.TempFile("", "luajitter-*.lua")
+	require.Nil(err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString("return 40 + 2")
+	require.Nil(err)
+	err = file.Close()
+	require.Nil(err)
+
+	fn, err := vm.LoadFile(file.Name())
+	require.Nil(err)
+	results, err := fn.Call()
+	require.Nil(err)
+	require.Equal([]interface{}{42.0}, results)
+	err = fn.Close()
+	require.Nil(err)
+
+	_, err = vm.LoadFile(file.Name() + ".missing")
+	require.NotNil(err)
+	require.Equal(ErrorKindFile, err.(*LuaError).Kind)
+}
+
+func TestNamedChunks(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	err := vm.DoStringNamed("rules/pricing.lua", "local price = 10\n\nerror('too expensive')")
+	require.NotNil(err)
+	luaErr := err.(*LuaError)
+	require.Equal("rules/pricing.lua", luaErr.ChunkName)
+	require.Equal(3, luaErr.Line)
+	require.Contains(luaErr.Message, "rules/pricing.lua:3: too expensive")
+	require.Contains(luaErr.Traceback, "rules/pricing.lua:3")
+
+	err = vm.DoStringNamed("@rules/discount.lua", "discount = 5")
+	require.Nil(err)
+
+	results, err := vm.Eval("return discount * 2, 'label', nil")
+	require.Nil(err)
+	require.Equal([]interface{}{10.0, "label", nil}, results)
+
+	results, err = vm.EvalNamed("empty.lua", "local x = 1")
+	require.Nil(err)
+	require.Len(results, 0)
+
+	_, err = vm.EvalNamed("bad.lua", "return +")
+	require.NotNil(err)
+	require.Equal(ErrorKindSyntax, err.(*LuaError).Kind)
+}
+
+type failingReader struct {
+	remaining io.Reader
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.remaining.Read(p)
+	if err == io.EOF {
+		return n, errors.New("archive is truncated")
+	}
+	return n, err
+}
+
+func TestLoadReader(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	//Large enough to take several reads from the reader
+	var source strings.Builder
+	source.WriteString("local total = 0\n")
+	for i := 1; i <= 5000; i++ {
+		source.WriteString(fmt.Sprintf("total = total + %d\n", i))
+	}
+	source.WriteString("return total\n")
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, err := writer.Write([]byte(source.String()))
+	require.Nil(err)
+	require.Nil(writer.Close())
+
+	reader, err := gzip.NewReader(&compressed)
+	require.Nil(err)
+	fn, err := vm.LoadReader(reader, "sum.lua")
+	require.Nil(err)
+
+	results, err := fn.Call()
+	require.Nil(err)
+	require.Equal([]interface{}{float64(5000 * 5001 / 2)}, results)
+	require.Nil(fn.Close())
+
+	_, err = vm.LoadReader(strings.NewReader("\nlocal x = = 1"), "broken.lua")
+	require.NotNil(err)
+	luaErr, isLuaErr := err.(*LuaError)
+	require.True(isLuaErr)
+	require.Equal(ErrorKindSyntax, luaErr.Kind)
+	require.Equal("broken.lua", luaErr.ChunkName)
+	require.Equal(2, luaErr.Line)
+
+	//A chunk cut short by a failing reader reports the read error rather than whatever lua made of the partial source
+	_, err = vm.LoadReader(&failingReader{remaining: strings.NewReader("return 1")}, "")
+	require.NotNil(err)
+	require.Equal("archive is truncated", err.Error())
+}
+
+func TestBytecode(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+	vm := NewState()
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	fn, err := vm.LoadString(`
+local a, b = ...
+if b == nil then error("missing b") end
+return a * b
+`, "multiply.lua")
+	require.Nil(err)
+	defer fn.Close()
+
+	bytecode, err := fn.Dump(false)
+	require.Nil(err)
+	stripped, err := fn.Dump(true)
+	require.Nil(err)
+	require.True(len(stripped) < len(bytecode))
+
+	loaded, err := vm.LoadBytecode(bytecode, "")
+	require.Nil(err)
+	results, err := loaded.Call(6, 7)
+	require.Nil(err)
+	require.Equal([]interface{}{float64(42)}, results)
+
+	//Debug info survives an unstripped dump
+	_, err = loaded.Call(6)
+	require.NotNil(err)
+	require.Equal("multiply.lua", err.(*LuaError).ChunkName)
+	require.Equal(3, err.(*LuaError).Line)
+	require.Nil(loaded.Close())
+
+	loaded, err = vm.LoadBytecode(stripped, "")
+	require.Nil(err)
+	results, err = loaded.Call(2, 3)
+	require.Nil(err)
+	require.Equal([]interface{}{float64(6)}, results)
+	require.Nil(loaded.Close())
+
+	_, err = vm.LoadBytecode([]byte("return 1"), "source.lua")
+	require.NotNil(err)
+
+	require.Nil(vm.DoString("string.dump = nil"))
+	_, err = fn.Dump(false)
+	require.Nil(err)
+
+	textOnly := NewState(WithTextOnlyChunks())
+	defer closeVM(t, textOnly)
+
+	_, err = textOnly.LoadString(string(bytecode), "untrusted")
+	require.NotNil(err)
+	_, err = textOnly.LoadReader(bytes.NewReader(bytecode), "untrusted")
+	require.NotNil(err)
+	require.NotNil(textOnly.DoString(string(bytecode)))
+
+	loaded, err = textOnly.LoadBytecode(bytecode, "trusted")
+	require.Nil(err)
+	require.Nil(loaded.Close())
+}
+
+func TestModuleFS(t *testing.T) {
+	require := require.New(t)
+	clearAllocs()
+
+	modules := fstest.MapFS{
+		"scripts/counter.lua": &fstest.MapFile{Data: []byte(`
+loads = (loads or 0) + 1
+return { name = ..., loads = loads }
+`)},
+		"scripts/util/init.lua":    &fstest.MapFile{Data: []byte(`return { greet = function(name) return "hello " .. name end }`)},
+		"scripts/util/strings.lua": &fstest.MapFile{Data: []byte(`return { upper = string.upper }`)},
+		"scripts/broken.lua":       &fstest.MapFile{Data: []byte("\nlocal x = = 1")},
+	}
+
+	vm := NewState(WithModuleFS(modules, "scripts/?.lua", "scripts/?/init.lua"))
+	defer func() {
+		closeVM(t, vm)
+		require.Equal(0, outlyingAllocs())
+	}()
+
+	results, err := vm.Eval(`
+local first = require("counter")
+local second = require("counter")
+return first == second, first.name, loads, package.loaded.counter == first
+`)
+	require.Nil(err)
+	require.Equal([]interface{}{true, "counter", float64(1), true}, results)
+
+	results, err = vm.Eval(`return require("util").greet("world"), require("util.strings").upper("abc")`)
+	require.Nil(err)
+	require.Equal([]interface{}{"hello world", "ABC"}, results)
+
+	_, err = vm.Eval(`require("missing.module")`)
+	require.NotNil(err)
+	require.Contains(err.Error(), "module 'missing.module' not found")
+	require.Contains(err.Error(), "no file 'scripts/missing/module.lua' in module fs")
+	require.Contains(err.Error(), "no file 'scripts/missing/module/init.lua' in module fs")
+
+	_, err = vm.Eval(`require("broken")`)
+	require.NotNil(err)
+	require.Contains(err.Error(), "error loading module 'broken' from file 'scripts/broken.lua'")
+	require.Contains(err.Error(), "scripts/broken.lua:2:")
+
+	//Preloaded modules still take priority
+	results, err = vm.Eval(`
+package.preload.util = function() return "preloaded" end
+package.loaded.util = nil
+return require("util")
+`)
+	require.Nil(err)
+	require.Equal([]interface{}{"preloaded"}, results)
+
+	defaults := NewState(WithModuleFS(fstest.MapFS{
+		"lib/init.lua": &fstest.MapFile{Data: []byte(`return 5`)},
+	}))
+	defer closeVM(t, defaults)
+
+	results, err = defaults.Eval(`return require("lib")`)
+	require.Nil(err)
+	require.Equal([]interface{}{float64(5)}, results)
+}
@@ -0,0 +1,241 @@
+package luajitter
+
+/*
+#include "go_luajit.h"
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"unsafe"
+)
+
+// LuaMarshaler is implemented by types that choose their own lua representation. MarshalLua returns any value
+// that can be pushed to lua, such as a string, number, map or struct.
+type LuaMarshaler interface {
+	MarshalLua() (interface{}, error)
+}
+
+func fromLuaMarshaler(vm *LuaState, marshaler LuaMarshaler, outValue *C.struct_lua_value) (*C.struct_lua_value, error) {
+	//A nil pointer doesn't get the chance to marshal itself, the same as encoding/json
+	reflected := reflect.ValueOf(marshaler)
+	if reflected.Kind() == reflect.Ptr && reflected.IsNil() {
+		return fromGoValue(vm, nil, outValue)
+	}
+
+	marshaled, err := marshaler.MarshalLua()
+	if err == nil && marshaled != nil && reflect.TypeOf(marshaled) == reflected.Type() {
+		err = fmt.Errorf("MarshalLua for %s returned its own type", reflected.Type())
+	}
+	if err != nil {
+		if outValue != nil {
+			C.free_lua_value(vm._l, outValue)
+		}
+		return nil, err
+	}
+
+	return fromGoValue(vm, marshaled, outValue)
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr, reflect.Func:
+		return v.IsNil()
+	}
+	return false
+}
+
+// checkTableKey rejects keys that lua raises an error for. The table is built outside of any protected call, so the
+// error would otherwise take down the whole process.
+func checkTableKey(key interface{}, cKey *C.struct_lua_value) error {
+	if cKey == nil {
+		return fmt.Errorf("cannot use %v (%T) as a lua table key, it marshals to nil", key, key)
+	}
+	if cKey.valueType == C.LUA_TNUMBER && math.IsNaN(float64(*(*C.double)(unsafe.Pointer(&cKey.data)))) {
+		return errors.New("cannot use NaN as a lua table key")
+	}
+	return nil
+}
+
+// fromGoEntries builds an unrolled table so that the whole structure is pushed to lua in one go
+func fromGoEntries(vm *LuaState, keys []interface{}, values []interface{}, arraySize int, outValue *C.struct_lua_value) (*C.struct_lua_value, error) {
+	if outValue == nil {
+		outValue = C.make_lua_value(vm._l)
+	}
+
+	outValue.temporary = C._Bool(true)
+	outValue.valueType = C.LUA_TUNROLLEDTABLE
+	valData := (*unsafe.Pointer)(unsafe.Pointer(&outValue.data))
+	table := C.build_unrolled_table(vm._l, C.int(len(keys)))
+	table.arraySize = C.uint(arraySize)
+	table.hashSize = C.uint(len(keys) - arraySize)
+	*valData = unsafe.Pointer(table)
+
+	var err error
+	entry := table.first
+	for i := range keys {
+		entry.key, err = fromGoKey(vm, keys[i], entry.key)
+		if err == nil {
+			err = checkTableKey(keys[i], entry.key)
+		}
+		if err != nil {
+			C.free_temporary_lua_value(vm._l, outValue)
+			return nil, err
+		}
+
+		entry.value, err = fromGoValue(vm, values[i], entry.value)
+		if err != nil {
+			C.free_temporary_lua_value(vm._l, outValue)
+			return nil, err
+		}
+
+		entry = entry.next
+	}
+
+	return outValue, nil
+}
+
+func fromReflectedStruct(vm *LuaState, reflected reflect.Value, outValue *C.struct_lua_value) (*C.struct_lua_value, error) {
+	fields := structFields(reflected.Type())
+	keys := make([]interface{}, 0, len(fields))
+	values := make([]interface{}, 0, len(fields))
+
+	for _, field := range fields {
+		fieldValue := reflected.FieldByIndex(field.index)
+		if field.omitEmpty && isEmptyValue(fieldValue) {
+			continue
+		}
+
+		keys = append(keys, field.name)
+		values = append(values, fieldValue.Interface())
+	}
+
+	return fromGoEntries(vm, keys, values, 0, outValue)
+}
+
+func fromReflectedSequence(vm *LuaState, reflected reflect.Value, outValue *C.struct_lua_value) (*C.struct_lua_value, error) {
+	length := reflected.Len()
+	keys := make([]interface{}, length)
+	values := make([]interface{}, length)
+
+	for i := 0; i < length; i++ {
+		keys[i] = i + 1
+		values[i] = reflected.Index(i).Interface()
+	}
+
+	return fromGoEntries(vm, keys, values, length, outValue)
+}
+
+func fromReflectedMap(vm *LuaState, reflected reflect.Value, outValue *C.struct_lua_value) (*C.struct_lua_value, error) {
+	keys := make([]interface{}, 0, reflected.Len())
+	values := make([]interface{}, 0, reflected.Len())
+
+	iter := reflected.MapRange()
+	for iter.Next() {
+		keys = append(keys, iter.Key().Interface())
+		values = append(values, iter.Value().Interface())
+	}
+
+	return fromGoEntries(vm, keys, values, 0, outValue)
+}
+
+type sliceVisit struct {
+	pointer uintptr
+	length  int
+}
+
+// marshalOnce runs marshal with key marked as in progress. A value that contains itself would otherwise be
+// marshaled until go runs out of stack, so reaching key again before marshal returns is an error, like encoding/json.
+func (s *LuaState) marshalOnce(key interface{}, reflected reflect.Value, outValue *C.struct_lua_value, marshal func() (*C.struct_lua_value, error)) (*C.struct_lua_value, error) {
+	if _, inProgress := s.marshaling[key]; inProgress {
+		if outValue != nil {
+			C.free_lua_value(s._l, outValue)
+		}
+		return nil, fmt.Errorf("cannot marshal cyclic value of type %s into lua", reflected.Type())
+	}
+
+	if s.marshaling == nil {
+		s.marshaling = make(map[interface{}]struct{})
+	}
+	s.marshaling[key] = struct{}{}
+	defer delete(s.marshaling, key)
+	return marshal()
+}
+
+// fromReflectedValue marshals the types fromGoValue does not know about directly: arbitrary functions,
+// named primitive types, pointers, structs, slices, arrays and typed maps
+func fromReflectedValue(vm *LuaState, reflected reflect.Value, outValue *C.struct_lua_value) (*C.struct_lua_value, error) {
+	switch reflected.Kind() {
+	case reflect.Func:
+		if reflected.IsNil() {
+			return fromGoValue(vm, nil, outValue)
+		}
+		return fromGoValue(vm, wrapReflectedFunction(reflected), outValue)
+	case reflect.Ptr, reflect.Interface:
+		if reflected.IsNil() {
+			return fromGoValue(vm, nil, outValue)
+		}
+		if reflected.Kind() == reflect.Ptr {
+			return vm.marshalOnce(reflected.Interface(), reflected, outValue, func() (*C.struct_lua_value, error) {
+				return fromGoValue(vm, reflected.Elem().Interface(), outValue)
+			})
+		}
+		return fromGoValue(vm, reflected.Elem().Interface(), outValue)
+	case reflect.Bool:
+		return fromGoValue(vm, reflected.Bool(), outValue)
+	case reflect.String:
+		return fromGoValue(vm, reflected.String(), outValue)
+	case reflect.Int64:
+		return fromGoValue(vm, reflected.Int(), outValue)
+	case reflect.Uint64:
+		return fromGoValue(vm, reflected.Uint(), outValue)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		return fromGoValue(vm, float64(reflected.Int()), outValue)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uintptr:
+		return fromGoValue(vm, float64(reflected.Uint()), outValue)
+	case reflect.Float32, reflect.Float64:
+		return fromGoValue(vm, reflected.Float(), outValue)
+	case reflect.Struct:
+		return fromReflectedStruct(vm, reflected, outValue)
+	case reflect.Slice:
+		if isByteSlice(reflected.Type()) {
+			return fromGoValue(vm, reflected.Bytes(), outValue)
+		}
+		if reflected.IsNil() {
+			return fromGoValue(vm, nil, outValue)
+		}
+		if reflected.Len() == 0 {
+			return fromReflectedSequence(vm, reflected, outValue)
+		}
+		key := sliceVisit{pointer: reflected.Pointer(), length: reflected.Len()}
+		return vm.marshalOnce(key, reflected, outValue, func() (*C.struct_lua_value, error) {
+			return fromReflectedSequence(vm, reflected, outValue)
+		})
+	case reflect.Array:
+		return fromReflectedSequence(vm, reflected, outValue)
+	case reflect.Map:
+		if reflected.IsNil() {
+			return fromGoValue(vm, nil, outValue)
+		}
+		return vm.marshalOnce(reflected.Pointer(), reflected, outValue, func() (*C.struct_lua_value, error) {
+			return fromReflectedMap(vm, reflected, outValue)
+		})
+	}
+
+	if outValue != nil {
+		C.free_lua_value(vm._l, outValue)
+	}
+	return nil, errors.New("cannot marshal unknown type into lua")
+}
@@ -0,0 +1,79 @@
+package luajitter
+
+/*
+#include "go_luajit.h"
+*/
+import "C"
+import (
+	"errors"
+	"reflect"
+	"unsafe"
+)
+
+// GetMetatable returns the value's metatable, or nil if it has none. The __metatable field is not consulted.
+func (d *LocalLuaData) GetMetatable() (*LocalLuaTable, error) {
+	vm := d.HomeVM()
+	cResult := C.get_metatable(vm._l, d.LuaValue())
+	if cResult.err != nil {
+		defer C.free_lua_error(vm._l, cResult.err)
+		return nil, LuaErrorToGo(vm, cResult.err)
+	}
+
+	if cResult.value == nil {
+		return nil, nil
+	}
+	return buildGoValue(vm, cResult.value).(*LocalLuaTable), nil
+}
+
+// SetMetatable replaces the metatable of a table or userdata, a nil metatable removes it
+func (d *LocalLuaData) SetMetatable(metatable *LocalLuaTable) error {
+	vm := d.HomeVM()
+	if d.value == nil {
+		return errors.New("cannot set metatable on closed value")
+	}
+	if d.value.valueType != C.LUA_TTABLE && d.value.valueType != C.LUA_TUSERDATA {
+		return errors.New("metatables can only be set on tables and userdata")
+	}
+
+	var cMetatable *C.struct_lua_value
+	if metatable != nil {
+		if metatable.HomeVM() != vm {
+			return errors.New("attempt to use local data in wrong VM")
+		}
+		cMetatable = metatable.LuaValue()
+	}
+
+	cErr := C.set_metatable(vm._l, d.LuaValue(), cMetatable)
+	defer C.free_lua_error(vm._l, cErr)
+	return LuaErrorToGo(vm, cErr)
+}
+
+// NewMetatable creates the metatable registered under name, the same as luaL_newmetatable, and sets fields on it.
+// If name is already registered, the existing metatable has the fields set on it instead. Go functions in fields
+// become real lua functions so that they can be used as metamethods such as __index, __newindex, __call,
+// __tostring, __eq and __lt.
+func (s *LuaState) NewMetatable(name string, fields map[string]interface{}) (*LocalLuaTable, error) {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	cResult := C.new_metatable(s._l, cName)
+	if cResult.err != nil {
+		defer C.free_lua_error(s._l, cResult.err)
+		return nil, LuaErrorToGo(s, cResult.err)
+	}
+	metatable := buildGoValue(s, cResult.value).(*LocalLuaTable)
+
+	for key, value := range fields {
+		if value != nil && reflect.TypeOf(value).Kind() == reflect.Func {
+			value = GoFunction{Func: value}
+		}
+
+		err := metatable.RawSet(key, value)
+		if err != nil {
+			metatable.Close()
+			return nil, err
+		}
+	}
+
+	return metatable, nil
+}
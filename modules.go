@@ -0,0 +1,93 @@
+package luajitter
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+// DefaultModulePaths are the templates WithModuleFS searches when none are given. Each '?' is replaced by the
+// module name with its dots turned into slashes, the same as package.path.
+var DefaultModulePaths = []string{"?.lua", "?/init.lua"}
+
+// WithModuleFS lets require load modules out of fsys, such as an embed.FS, os.DirFS or zip archive. The templates in
+// paths are tried in order, after package.preload but before package.path. Loaded modules are cached in
+// package.loaded like any other.
+func WithModuleFS(fsys fs.FS, paths ...string) StateOption {
+	if len(paths) == 0 {
+		paths = DefaultModulePaths
+	}
+	return func(s *LuaState) {
+		s.moduleFS = fsys
+		s.modulePaths = paths
+	}
+}
+
+//The searcher compiles in lua so that the loader it hands back to require doesn't have to pass through go
+const moduleSearcher = `
+local readModule, mode = ...
+local load, error = load, error
+local searchers = package.searchers or package.loaders
+table.insert(searchers, 2, function(name)
+	local source, path = readModule(name)
+	if source == nil then
+		return path
+	end
+
+	local chunk, err = load(source, "@" .. path, mode)
+	if chunk == nil then
+		error("error loading module '" .. name .. "' from file '" .. path .. "':\n\t" .. err, 0)
+	end
+	return chunk, path
+end)
+`
+
+func (s *LuaState) installModuleSearcher() error {
+	searcher, err := s.LoadString(moduleSearcher, "=luajitter module searcher")
+	if err != nil {
+		return err
+	}
+	defer searcher.Close()
+
+	_, err = searcher.Call(s.readModule, s.chunkMode())
+	return err
+}
+
+// readModule returns the source and path of the first file the module paths find for a module name, or nil and
+// a list of the paths searched in the form require expects
+func (s *LuaState) readModule(args []interface{}) ([]interface{}, error) {
+	var name string
+	if len(args) > 0 {
+		switch arg := args[0].(type) {
+		case string:
+			name = arg
+		case []byte:
+			name = string(arg)
+		}
+	}
+	if name == "" {
+		return nil, errors.New("module name must be a non-empty string")
+	}
+
+	modulePath := strings.ReplaceAll(name, ".", "/")
+	var searched strings.Builder
+	for _, template := range s.modulePaths {
+		path := strings.ReplaceAll(template, "?", modulePath)
+		if !fs.ValidPath(path) {
+			fmt.Fprintf(&searched, "\n\tno file '%s' in module fs", path)
+			continue
+		}
+
+		source, err := fs.ReadFile(s.moduleFS, path)
+		if errors.Is(err, fs.ErrNotExist) {
+			fmt.Fprintf(&searched, "\n\tno file '%s' in module fs", path)
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("error loading module '%s' from file '%s':\n\t%v", name, path, err)
+		}
+		return []interface{}{source, path}, nil
+	}
+
+	return []interface{}{nil, searched.String()}, nil
+}
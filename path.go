@@ -0,0 +1,278 @@
+package luajitter
+
+/*
+#include "go_luajit.h"
+*/
+import "C"
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type pathParser struct {
+	path string
+	pos  int
+}
+
+func (p *pathParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("invalid path '%s' at offset %d: %s", p.path, p.pos, fmt.Sprintf(format, args...))
+}
+
+// parsePath splits a path such as `a["x.y"].b[3]['10']` into table keys. Bare segments are split on '.' and
+// are integers if they are made up entirely of digits, bracketed segments hold a quoted string, a number,
+// true or false. Quoted strings take the same escape sequences as lua string literals.
+func parsePath(path string) ([]interface{}, error) {
+	p := &pathParser{path: path}
+	var keys []interface{}
+
+	for {
+		var key interface{}
+		var err error
+		if p.pos < len(p.path) && p.path[p.pos] == '[' {
+			key, err = p.parseBracket()
+		} else {
+			key, err = p.parseName()
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+
+		if p.pos >= len(p.path) {
+			return keys, nil
+		}
+
+		switch p.path[p.pos] {
+		case '.':
+			p.pos++
+		case '[':
+		default:
+			return nil, p.errorf("unexpected '%c'", p.path[p.pos])
+		}
+	}
+}
+
+func (p *pathParser) parseName() (interface{}, error) {
+	start := p.pos
+	for p.pos < len(p.path) && p.path[p.pos] != '.' && p.path[p.pos] != '[' {
+		p.pos++
+	}
+
+	name := p.path[start:p.pos]
+	if name == "" {
+		return nil, p.errorf("walked path segment zero length")
+	}
+
+	if strings.Trim(name, "0123456789") == "" {
+		if index, err := strconv.Atoi(name); err == nil {
+			return index, nil
+		}
+	}
+	return name, nil
+}
+
+func (p *pathParser) parseBracket() (interface{}, error) {
+	//Skip the opening bracket
+	p.pos++
+	if p.pos >= len(p.path) {
+		return nil, p.errorf("unterminated '['")
+	}
+
+	var key interface{}
+	var err error
+	if p.path[p.pos] == '"' || p.path[p.pos] == '\'' {
+		key, err = p.parseQuoted()
+	} else {
+		key, err = p.parseLiteral()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos >= len(p.path) || p.path[p.pos] != ']' {
+		return nil, p.errorf("expected ']'")
+	}
+	p.pos++
+	return key, nil
+}
+
+func (p *pathParser) parseQuoted() (interface{}, error) {
+	quote := p.path[p.pos]
+	p.pos++
+
+	var out strings.Builder
+	for {
+		if p.pos >= len(p.path) {
+			return nil, p.errorf("unterminated string")
+		}
+		if p.path[p.pos] == quote {
+			p.pos++
+			return out.String(), nil
+		}
+		if p.path[p.pos] != '\\' {
+			out.WriteByte(p.path[p.pos])
+			p.pos++
+			continue
+		}
+
+		err := p.parseEscape(&out)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+var luaEscapes = map[byte]byte{
+	'a': '\a', 'b': '\b', 'f': '\f', 'n': '\n', 'r': '\r', 't': '\t', 'v': '\v',
+	'\\': '\\', '"': '"', '\'': '\'', '\n': '\n',
+}
+
+// parseEscape reads one of lua's escape sequences into out, starting from the backslash
+func (p *pathParser) parseEscape(out *strings.Builder) error {
+	start := p.pos
+	p.pos++
+	if p.pos >= len(p.path) {
+		return p.errorf("unterminated string")
+	}
+
+	escape := p.path[p.pos]
+	p.pos++
+	if value, isSimple := luaEscapes[escape]; isSimple {
+		out.WriteByte(value)
+		return nil
+	}
+
+	switch {
+	case escape >= '0' && escape <= '9':
+		//Up to three decimal digits
+		digits := p.pos - 1
+		for p.pos < len(p.path) && p.pos-digits < 3 && p.path[p.pos] >= '0' && p.path[p.pos] <= '9' {
+			p.pos++
+		}
+		value, _ := strconv.Atoi(p.path[digits:p.pos])
+		if value > 255 {
+			p.pos = start
+			return p.errorf("decimal escape too large")
+		}
+		out.WriteByte(byte(value))
+		return nil
+	case escape == 'x':
+		if p.pos+2 <= len(p.path) {
+			value, err := strconv.ParseUint(p.path[p.pos:p.pos+2], 16, 8)
+			if err == nil {
+				p.pos += 2
+				out.WriteByte(byte(value))
+				return nil
+			}
+		}
+	case escape == 'u':
+		end := strings.IndexByte(p.path[p.pos:], '}')
+		if p.pos < len(p.path) && p.path[p.pos] == '{' && end > 1 {
+			value, err := strconv.ParseUint(p.path[p.pos+1:p.pos+end], 16, 32)
+			if err == nil && value <= utf8.MaxRune {
+				p.pos += end + 1
+				out.WriteRune(rune(value))
+				return nil
+			}
+		}
+	case escape == 'z':
+		//Skips the whitespace that follows
+		for p.pos < len(p.path) && strings.IndexByte(" \t\n\r\f\v", p.path[p.pos]) >= 0 {
+			p.pos++
+		}
+		return nil
+	}
+
+	p.pos = start
+	return p.errorf("invalid escape in string")
+}
+
+func (p *pathParser) parseLiteral() (interface{}, error) {
+	start := p.pos
+	for p.pos < len(p.path) && p.path[p.pos] != ']' {
+		p.pos++
+	}
+
+	literal := strings.TrimSpace(p.path[start:p.pos])
+	switch literal {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+
+	number, err := strconv.ParseFloat(literal, 64)
+	if err != nil || math.IsNaN(number) {
+		p.pos = start
+		return nil, p.errorf("bracketed key must be a quoted string, number or boolean")
+	}
+	return number, nil
+}
+
+// formatPath builds a readable path out of keys for error messages
+func formatPath(keys []interface{}) string {
+	var out strings.Builder
+	for i, key := range keys {
+		if name, isString := key.(string); isString && name != "" && !strings.ContainsAny(name, ".[]\"'") {
+			if i > 0 {
+				out.WriteByte('.')
+			}
+			out.WriteString(name)
+			continue
+		}
+
+		switch v := key.(type) {
+		case string:
+			out.WriteString("[" + strconv.Quote(v) + "]")
+		default:
+			out.WriteString(fmt.Sprintf("[%v]", v))
+		}
+	}
+	return out.String()
+}
+
+// withPathKeys marshals path keys into lua values for the duration of walk
+func withPathKeys(vm *LuaState, keys []interface{}, walk func(cKeys C.lua_args) error) error {
+	cValues := make([]*C.struct_lua_value, len(keys))
+	defer func() {
+		for _, cValue := range cValues {
+			if cValue != nil && cValue.temporary == C._Bool(true) {
+				C.free_temporary_lua_value(vm._l, cValue)
+			}
+		}
+	}()
+
+	for i, key := range keys {
+		//Lua raises an error for these rather than reporting a missing key
+		switch k := key.(type) {
+		case nil:
+			return fmt.Errorf("path key %d is nil", i+1)
+		case float64:
+			if math.IsNaN(k) {
+				return fmt.Errorf("path key %d is NaN", i+1)
+			}
+		case float32:
+			if math.IsNaN(float64(k)) {
+				return fmt.Errorf("path key %d is NaN", i+1)
+			}
+		}
+
+		cValue, err := fromGoKey(vm, key, nil)
+		if err != nil {
+			return err
+		}
+		cValues[i] = cValue
+	}
+
+	cKeys := C.lua_args{
+		valueCount: C.int(len(keys)),
+		values:     nil,
+	}
+	if len(cValues) > 0 {
+		cKeys.values = &cValues[0]
+	}
+	return walk(cKeys)
+}
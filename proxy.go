@@ -0,0 +1,158 @@
+package luajitter
+
+/*
+#include "go_luajit.h"
+*/
+import "C"
+import (
+	"fmt"
+	"reflect"
+)
+
+// Proxy pushes Value into lua as a userdata rather than copying it. Lua can read and assign the exported fields of
+// a struct pointer and call its exported methods, e.g. `player:TakeDamage(10)`, and the same go value is returned
+// when the userdata comes back out of lua.
+type Proxy struct {
+	Value interface{}
+}
+
+func (s *LuaState) initProxyMetatable() error {
+	metatable, err := s.NewMetatable(C.MT_GOPROXY, map[string]interface{}{
+		"__index":    proxyIndex,
+		"__newindex": proxyNewIndex,
+		"__tostring": proxyToString,
+		"__eq":       proxyEquals,
+	})
+	if err != nil {
+		return err
+	}
+	return metatable.Close()
+}
+
+// proxyElem finds the struct behind a proxied value, if there is one
+func proxyElem(proxied reflect.Value) (reflect.Value, bool) {
+	for proxied.Kind() == reflect.Ptr || proxied.Kind() == reflect.Interface {
+		if proxied.IsNil() {
+			return reflect.Value{}, false
+		}
+		proxied = proxied.Elem()
+	}
+	return proxied, proxied.Kind() == reflect.Struct
+}
+
+// proxyMember returns the field or method called name on a proxied value
+func proxyMember(proxied reflect.Value, name string) (interface{}, bool) {
+	method := proxied.MethodByName(name)
+	if method.IsValid() {
+		//Methods are called with a colon, so lua passes the userdata itself as the first argument
+		wrapped := wrapReflectedFunction(method)
+		return GoFunction{Func: func(state *LuaState, args []interface{}) ([]interface{}, error) {
+			if len(args) > 0 {
+				args = args[1:]
+			}
+			switch callback := wrapped.(type) {
+			case func(*LuaState, []interface{}) ([]interface{}, error):
+				return callback(state, args)
+			case func([]interface{}) ([]interface{}, error):
+				return callback(args)
+			}
+			return nil, fmt.Errorf("cannot call method '%s' on %s", name, proxied.Type())
+		}}, true
+	}
+
+	elem, isStruct := proxyElem(proxied)
+	if !isStruct {
+		return nil, false
+	}
+
+	field, found := findField(structFields(elem.Type()), name)
+	if !found {
+		return nil, false
+	}
+
+	fieldValue := elem.FieldByIndex(field.index)
+	if fieldValue.Kind() == reflect.Struct && fieldValue.CanAddr() {
+		//Nested structs are proxied as well so that assignments reach the original
+		return Proxy{Value: fieldValue.Addr().Interface()}, true
+	}
+	if fieldValue.Kind() == reflect.Ptr && !fieldValue.IsNil() && fieldValue.Elem().Kind() == reflect.Struct {
+		return Proxy{Value: fieldValue.Interface()}, true
+	}
+	return fieldValue.Interface(), true
+}
+
+func proxyIndex(args []interface{}) ([]interface{}, error) {
+	closeUnusedArguments(args, nil)
+	if len(args) < 2 {
+		return []interface{}{nil}, nil
+	}
+
+	name, isString := args[1].(string)
+	if !isString {
+		return []interface{}{nil}, nil
+	}
+
+	member, _ := proxyMember(reflect.ValueOf(args[0]), name)
+	return []interface{}{member}, nil
+}
+
+func proxyNewIndex(args []interface{}) ([]interface{}, error) {
+	if len(args) < 3 {
+		closeUnusedArguments(args, nil)
+		return nil, fmt.Errorf("attempt to assign to proxy without a key")
+	}
+
+	proxied := args[0]
+	name, isString := args[1].(string)
+	elem, isStruct := proxyElem(reflect.ValueOf(proxied))
+	var field fieldInfo
+	found := false
+	if isString && isStruct {
+		field, found = findField(structFields(elem.Type()), name)
+	}
+	if !found {
+		closeUnusedArguments(args, nil)
+		return nil, fmt.Errorf("no field '%v' on %T", args[1], proxied)
+	}
+
+	fieldValue := elem.FieldByIndex(field.index)
+	if !fieldValue.CanSet() {
+		closeUnusedArguments(args, nil)
+		return nil, fmt.Errorf("cannot assign to field '%s' on %T, proxy a pointer to modify fields", name, proxied)
+	}
+
+	converted, err := convertValue(args[2], fieldValue.Type())
+	used := make([]bool, len(args))
+	if _, isLocal := args[2].(LocalData); isLocal && err == nil && converted.Interface() == args[2] {
+		used[2] = true
+	}
+	closeUnusedArguments(args, used)
+	if err != nil {
+		return nil, fmt.Errorf("cannot assign to field '%s': %s", name, err.Error())
+	}
+
+	fieldValue.Set(converted)
+	return nil, nil
+}
+
+func proxyToString(args []interface{}) ([]interface{}, error) {
+	closeUnusedArguments(args, nil)
+	if len(args) < 1 {
+		return []interface{}{nil}, nil
+	}
+	return []interface{}{fmt.Sprint(args[0])}, nil
+}
+
+func proxyEquals(args []interface{}) ([]interface{}, error) {
+	closeUnusedArguments(args, nil)
+	if len(args) < 2 || args[0] == nil || args[1] == nil {
+		return []interface{}{false}, nil
+	}
+
+	//Each push makes a new userdata, so proxies are equal when they hold the same go value
+	lhsType := reflect.TypeOf(args[0])
+	if lhsType != reflect.TypeOf(args[1]) || !lhsType.Comparable() {
+		return []interface{}{false}, nil
+	}
+	return []interface{}{args[0] == args[1]}, nil
+}
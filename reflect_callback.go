@@ -0,0 +1,129 @@
+package luajitter
+
+import (
+	"fmt"
+	"reflect"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+var luaStateType = reflect.TypeOf((*LuaState)(nil))
+
+type ArgumentError struct {
+	Index    int
+	Function string
+	Message  string
+}
+
+func (e *ArgumentError) Error() string {
+	function := e.Function
+	if function == "" {
+		function = "?"
+	}
+	return fmt.Sprintf("bad argument #%d to '%s' (%s)", e.Index, function, e.Message)
+}
+
+func closeUnusedArguments(args []interface{}, used []bool) {
+	for i, arg := range args {
+		if used != nil && used[i] {
+			continue
+		}
+
+		if localData, isLocal := arg.(LocalData); isLocal {
+			localData.Close()
+		}
+	}
+}
+
+func reflectArguments(fnType reflect.Type, in []reflect.Value, args []interface{}) ([]reflect.Value, []bool, error) {
+	firstParam := len(in)
+	fixedCount := fnType.NumIn() - firstParam
+	if fnType.IsVariadic() {
+		fixedCount--
+	}
+
+	argCount := fixedCount
+	if fnType.IsVariadic() && len(args) > fixedCount {
+		argCount = len(args)
+	}
+
+	used := make([]bool, len(args))
+	for i := 0; i < argCount; i++ {
+		var paramType reflect.Type
+		if i >= fixedCount {
+			paramType = fnType.In(firstParam + fixedCount).Elem()
+		} else {
+			paramType = fnType.In(firstParam + i)
+		}
+
+		if i >= len(args) {
+			if !canBeNil(paramType) {
+				return nil, nil, &ArgumentError{
+					Index:   i + 1,
+					Message: fmt.Sprintf("%s expected, got no value", expectedTypeName(paramType)),
+				}
+			}
+			in = append(in, reflect.Zero(paramType))
+			continue
+		}
+
+		converted, err := convertValue(args[i], paramType)
+		if err != nil {
+			return nil, nil, &ArgumentError{
+				Index:   i + 1,
+				Message: err.Error(),
+			}
+		}
+
+		in = append(in, converted)
+		if _, isLocal := args[i].(LocalData); isLocal && converted.Interface() == args[i] {
+			used[i] = true
+		}
+	}
+
+	return in, used, nil
+}
+
+// wrapReflectedFunction adapts an arbitrary go function into one of the callback signatures lua calls into.
+// Functions whose first parameter is a *LuaState receive the calling state.
+func wrapReflectedFunction(fn reflect.Value) interface{} {
+	fnType := fn.Type()
+	outCount := fnType.NumOut()
+	returnsError := outCount > 0 && fnType.Out(outCount-1) == errorType
+	if returnsError {
+		outCount--
+	}
+
+	callback := func(state *LuaState, args []interface{}) ([]interface{}, error) {
+		var in []reflect.Value
+		if fnType.NumIn() > 0 && fnType.In(0) == luaStateType {
+			in = append(in, reflect.ValueOf(state))
+		}
+
+		in, used, err := reflectArguments(fnType, in, args)
+		closeUnusedArguments(args, used)
+		if err != nil {
+			return nil, err
+		}
+
+		out := fn.Call(in)
+		if returnsError {
+			errValue := out[outCount].Interface()
+			if errValue != nil {
+				return nil, errValue.(error)
+			}
+		}
+
+		retVals := make([]interface{}, outCount)
+		for i := 0; i < outCount; i++ {
+			retVals[i] = out[i].Interface()
+		}
+		return retVals, nil
+	}
+
+	if fnType.NumIn() > 0 && fnType.In(0) == luaStateType {
+		return callback
+	}
+	return func(args []interface{}) ([]interface{}, error) {
+		return callback(nil, args)
+	}
+}
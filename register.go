@@ -0,0 +1,180 @@
+package luajitter
+
+/*
+#include "go_luajit.h"
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Property exposes a value to lua as a field. Get is called as func(value T) V and Set, if present, as
+// func(value T, v V), with any of the usual callback signatures also accepted.
+type Property struct {
+	Get interface{}
+	Set interface{}
+}
+
+// TypeDefinition describes the lua class a go type is exposed as
+type TypeDefinition struct {
+	// Name is the path of the global class table, which holds the constructor as `new` along with the methods
+	Name string
+	// Constructor is exposed as Name.new and should return a value of the registered type
+	Constructor interface{}
+	// Methods are called with a colon in lua, and receive the value as their first argument
+	Methods map[string]interface{}
+	// Properties are read and assigned like fields
+	Properties map[string]Property
+	// Metamethods such as __add, __len, __concat and __tostring, which receive the value like methods do
+	Metamethods map[string]interface{}
+}
+
+type registeredType struct {
+	id         int
+	definition TypeDefinition
+}
+
+//The accessors are lua functions so that reading a method does not need a trip through go
+const typeAccessors = `
+local name, methods, getters, setters = ...
+local function index(self, key)
+	local method = methods[key]
+	if method ~= nil then
+		return method
+	end
+
+	local getter = getters[key]
+	if getter ~= nil then
+		return getter(self)
+	end
+	return nil
+end
+
+local function newindex(self, key, value)
+	local setter = setters[key]
+	if setter == nil then
+		error("cannot assign to '" .. tostring(key) .. "' on " .. name, 2)
+	end
+	setter(self, value)
+end
+
+return index, newindex
+`
+
+func asGoFunction(fn interface{}) interface{} {
+	if _, isGoFunction := fn.(GoFunction); isGoFunction || fn == nil {
+		return fn
+	}
+	return GoFunction{Func: fn}
+}
+
+// RegisterType exposes values of sample's type to lua as userdata of the class described by definition. Once a type
+// is registered, its values are always pushed to lua as userdata and come back out as the same go value.
+func (s *LuaState) RegisterType(sample interface{}, definition TypeDefinition) error {
+	if sample == nil {
+		return errors.New("cannot register the nil type")
+	}
+	goType := reflect.TypeOf(sample)
+	if _, registered := s.registeredTypes[goType]; registered {
+		return fmt.Errorf("type %s is already registered", goType)
+	}
+	if definition.Name == "" {
+		return errors.New("registered types need a name")
+	}
+
+	class, err := s.NewTable()
+	if err != nil {
+		return err
+	}
+	defer class.Close()
+	getters, err := s.NewTable()
+	if err != nil {
+		return err
+	}
+	defer getters.Close()
+	setters, err := s.NewTable()
+	if err != nil {
+		return err
+	}
+	defer setters.Close()
+
+	for name, method := range definition.Methods {
+		err = class.RawSet(name, asGoFunction(method))
+		if err != nil {
+			return err
+		}
+	}
+	for name, property := range definition.Properties {
+		if property.Get != nil {
+			err = getters.RawSet(name, asGoFunction(property.Get))
+			if err != nil {
+				return err
+			}
+		}
+		if property.Set != nil {
+			err = setters.RawSet(name, asGoFunction(property.Set))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if definition.Constructor != nil {
+		err = class.RawSet("new", asGoFunction(definition.Constructor))
+		if err != nil {
+			return err
+		}
+	}
+
+	accessors, err := s.LoadString(typeAccessors, "=luajitter type accessors")
+	if err != nil {
+		return err
+	}
+	defer accessors.Close()
+	results, err := accessors.Call(definition.Name, class, getters, setters)
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		defer result.(LocalData).Close()
+	}
+
+	typeId := len(s.registeredTypes) + 1
+	cResult := C.new_type_metatable(s._l, C.int(typeId))
+	if cResult.err != nil {
+		defer C.free_lua_error(s._l, cResult.err)
+		return LuaErrorToGo(s, cResult.err)
+	}
+	metatable := buildGoValue(s, cResult.value).(*LocalLuaTable)
+	defer metatable.Close()
+
+	metamethods := map[string]interface{}{
+		"__index":    results[0],
+		"__newindex": results[1],
+		"__eq":       GoFunction{Func: proxyEquals},
+	}
+	for name, metamethod := range definition.Metamethods {
+		metamethods[name] = asGoFunction(metamethod)
+	}
+	for name, metamethod := range metamethods {
+		err = metatable.RawSet(name, metamethod)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.InitGlobal(definition.Name, class)
+	if err != nil {
+		return err
+	}
+
+	if s.registeredTypes == nil {
+		s.registeredTypes = make(map[reflect.Type]*registeredType)
+	}
+	s.registeredTypes[goType] = &registeredType{
+		id:         typeId,
+		definition: definition,
+	}
+	return nil
+}
@@ -7,7 +7,10 @@ import "C"
 
 import (
 	"errors"
+	"fmt"
 	"github.com/baohavan/go-pointer"
+	"math"
+	"reflect"
 	"unsafe"
 )
 
@@ -24,9 +27,29 @@ var luaReturnSize C.size_t = C.size_t(unsafe.Sizeof(C.lua_return{}))
 
 func fromGoValue(vm *LuaState, value interface{}, outValue *C.struct_lua_value) (cValue *C.struct_lua_value, err error) {
 	if value == nil {
+		if outValue != nil {
+			C.free_lua_value(vm._l, outValue)
+		}
 		return nil, nil
 	}
 
+	if registered, isRegistered := vm.registeredTypes[reflect.TypeOf(value)]; isRegistered {
+		return fromRegisteredType(vm, registered, value, outValue), nil
+	}
+
+	if marshaler, isMarshaler := value.(LuaMarshaler); isMarshaler {
+		return fromLuaMarshaler(vm, marshaler, outValue)
+	}
+
+	if vm.int64Cdata {
+		switch v := value.(type) {
+		case int64:
+			return fromGoInt64(vm, C.LUA_TINT64, uint64(v), outValue), nil
+		case uint64:
+			return fromGoInt64(vm, C.LUA_TUINT64, v, outValue), nil
+		}
+	}
+
 	switch v := value.(type) {
 	case uint64, uint32, int32, int64, int, uint, float64, float32:
 		var castV float64
@@ -65,17 +88,9 @@ func fromGoValue(vm *LuaState, value interface{}, outValue *C.struct_lua_value)
 		valData := (*C._Bool)(unsafe.Pointer(&outValue.data))
 		*valData = C._Bool(v)
 	case string:
-		if outValue == nil {
-			outValue = C.make_lua_value(vm._l)
-		}
-
-		outValue.temporary = C._Bool(true)
-		outValue.valueType = C.LUA_TSTRING
-		valData := (**C.char)(unsafe.Pointer(&outValue.data))
-		*valData = C.CString(v)
-		C.increment_allocs()
-		valDataArg := (*C.size_t)(unsafe.Pointer(&outValue.dataArg))
-		*valDataArg = C.size_t(len(v))
+		outValue = fromGoString(vm, v, outValue)
+	case []byte:
+		outValue = fromGoString(vm, string(v), outValue)
 	case *LocalLuaFunction, *LocalLuaData, *LocalLuaTable:
 		castV := v.(LocalData)
 		if outValue != nil {
@@ -85,7 +100,7 @@ func fromGoValue(vm *LuaState, value interface{}, outValue *C.struct_lua_value)
 			return nil, errors.New("attempt to use local data in wrong VM")
 		}
 		outValue = castV.LuaValue()
-	case func([]interface{}) ([]interface{}, error):
+	case func([]interface{}) ([]interface{}, error), func(*LuaState, []interface{}) ([]interface{}, error):
 		if outValue == nil {
 			outValue = C.make_lua_value(vm._l)
 		}
@@ -96,41 +111,190 @@ func fromGoValue(vm *LuaState, value interface{}, outValue *C.struct_lua_value)
 
 		valData := (*unsafe.Pointer)(unsafe.Pointer(&outValue.data))
 		*valData = ptr
-	case map[interface{}]interface{}:
+	case Proxy:
+		if v.Value == nil {
+			return fromGoValue(vm, nil, outValue)
+		}
+
 		if outValue == nil {
 			outValue = C.make_lua_value(vm._l)
 		}
 
 		outValue.temporary = C._Bool(true)
-		outValue.valueType = C.LUA_TUNROLLEDTABLE
-		valData := (*unsafe.Pointer)(unsafe.Pointer(&outValue.data))
-		table := C.build_unrolled_table(vm._l, C.int(len(v)))
-		*valData = unsafe.Pointer(table)
+		outValue.valueType = C.LUA_TGOPROXY
+		ptr := pointer.Save(v.Value)
 
-		entry := table.first
-
-		for key, value := range v {
-			entry.key, err = fromGoValue(vm, key, entry.key)
-			if err != nil {
-				C.free_temporary_lua_value(vm._l, outValue);
-				return nil, err
+		valData := (*unsafe.Pointer)(unsafe.Pointer(&outValue.data))
+		*valData = ptr
+	case GoFunction:
+		callback, err := v.callback()
+		if err != nil {
+			if outValue != nil {
+				C.free_lua_value(vm._l, outValue)
 			}
+			return nil, err
+		}
 
-			entry.value, err = fromGoValue(vm, value, entry.value)
-			if err != nil {
-				C.free_temporary_lua_value(vm._l, outValue);
-				return nil, err
-			}
+		if outValue == nil {
+			outValue = C.make_lua_value(vm._l)
+		}
 
-			entry = entry.next
+		outValue.temporary = C._Bool(true)
+		outValue.valueType = C.LUA_TGOFUNCTION
+		ptr := pointer.Save(callback)
+
+		valData := (*unsafe.Pointer)(unsafe.Pointer(&outValue.data))
+		*valData = ptr
+	case error:
+		if outValue == nil {
+			outValue = C.make_lua_value(vm._l)
 		}
+
+		outValue.temporary = C._Bool(true)
+		outValue.valueType = C.LUA_TGOERROR
+		ptr := pointer.Save(v)
+
+		valData := (*unsafe.Pointer)(unsafe.Pointer(&outValue.data))
+		*valData = ptr
+	case map[interface{}]interface{}:
+		reflected := reflect.ValueOf(v)
+		return vm.marshalOnce(reflected.Pointer(), reflected, outValue, func() (*C.struct_lua_value, error) {
+			return fromGoMap(vm, v, outValue)
+		})
 	default:
-		return nil, errors.New("cannot marshal unknown type into lua")
+		return fromReflectedValue(vm, reflect.ValueOf(value), outValue)
 	}
 
 	return outValue, nil
 }
 
+func fromGoMap(vm *LuaState, v map[interface{}]interface{}, outValue *C.struct_lua_value) (*C.struct_lua_value, error) {
+	if outValue == nil {
+		outValue = C.make_lua_value(vm._l)
+	}
+
+	outValue.temporary = C._Bool(true)
+	outValue.valueType = C.LUA_TUNROLLEDTABLE
+	valData := (*unsafe.Pointer)(unsafe.Pointer(&outValue.data))
+	table := C.build_unrolled_table(vm._l, C.int(len(v)))
+	*valData = unsafe.Pointer(table)
+
+	var err error
+	entry := table.first
+
+	for key, value := range v {
+		entry.key, err = fromGoKey(vm, key, entry.key)
+		if err == nil {
+			err = checkTableKey(key, entry.key)
+		}
+		if err != nil {
+			C.free_temporary_lua_value(vm._l, outValue);
+			return nil, err
+		}
+
+		entry.value, err = fromGoValue(vm, value, entry.value)
+		if err != nil {
+			C.free_temporary_lua_value(vm._l, outValue);
+			return nil, err
+		}
+
+		entry = entry.next
+	}
+
+	return outValue, nil
+}
+
+func fromRegisteredType(vm *LuaState, registered *registeredType, value interface{}, outValue *C.struct_lua_value) *C.struct_lua_value {
+	if outValue == nil {
+		outValue = C.make_lua_value(vm._l)
+	}
+
+	outValue.temporary = C._Bool(true)
+	outValue.valueType = C.LUA_TGOUSERDATA
+	ptr := pointer.Save(value)
+
+	valData := (*unsafe.Pointer)(unsafe.Pointer(&outValue.data))
+	*valData = ptr
+	userDataType := (*C.int)(unsafe.Pointer(&outValue.dataArg))
+	*userDataType = C.META_GOTYPE_BASE + C.int(registered.id)
+	return outValue
+}
+
+func fromGoInt64(vm *LuaState, valueType C.int, bits uint64, outValue *C.struct_lua_value) *C.struct_lua_value {
+	if outValue == nil {
+		outValue = C.make_lua_value(vm._l)
+	}
+
+	outValue.temporary = C._Bool(true)
+	outValue.valueType = valueType
+	valData := (*C.uint64_t)(unsafe.Pointer(&outValue.data))
+	*valData = C.uint64_t(bits)
+	return outValue
+}
+
+// fromGoKey converts a table key. Boxed int64 cdata compares by identity, so a fresh box would never match an
+// existing key- with WithInt64Cdata, integer keys are still passed as lua numbers as long as a double can hold them
+// exactly.
+func fromGoKey(vm *LuaState, key interface{}, outValue *C.struct_lua_value) (*C.struct_lua_value, error) {
+	if !vm.int64Cdata || key == nil {
+		return fromGoValue(vm, key, outValue)
+	}
+	if _, isRegistered := vm.registeredTypes[reflect.TypeOf(key)]; isRegistered {
+		return fromGoValue(vm, key, outValue)
+	}
+	if _, isMarshaler := key.(LuaMarshaler); isMarshaler {
+		return fromGoValue(vm, key, outValue)
+	}
+
+	reflected := reflect.ValueOf(key)
+	switch reflected.Kind() {
+	case reflect.Int64:
+		number := float64(reflected.Int())
+		if number >= math.MaxInt64 || int64(number) != reflected.Int() {
+			return nil, fmt.Errorf("int64 table key %d cannot be held exactly by a lua number", reflected.Int())
+		}
+		return fromGoValue(vm, number, outValue)
+	case reflect.Uint64:
+		number := float64(reflected.Uint())
+		if number >= math.MaxUint64 || uint64(number) != reflected.Uint() {
+			return nil, fmt.Errorf("uint64 table key %d cannot be held exactly by a lua number", reflected.Uint())
+		}
+		return fromGoValue(vm, number, outValue)
+	}
+	return fromGoValue(vm, key, outValue)
+}
+
+func fromGoString(vm *LuaState, value string, outValue *C.struct_lua_value) *C.struct_lua_value {
+	if outValue == nil {
+		outValue = C.make_lua_value(vm._l)
+	}
+
+	outValue.temporary = C._Bool(true)
+	outValue.valueType = C.LUA_TSTRING
+	//CString copies every byte of the string, embedded NULs included, so the length is what marks the end
+	valData := (**C.char)(unsafe.Pointer(&outValue.data))
+	*valData = C.CString(value)
+	C.increment_allocs()
+	valDataArg := (*C.size_t)(unsafe.Pointer(&outValue.dataArg))
+	*valDataArg = C.size_t(len(value))
+	return outValue
+}
+
+// buildGoKey is buildGoValue for table keys, which are always returned as something go can hash
+func buildGoKey(vm *LuaState, value *C.struct_lua_value) interface{} {
+	if value != nil && value.valueType == C.LUA_TSTRING {
+		value.temporary = C._Bool(true)
+		return goStringFromLua(value)
+	}
+	return buildGoValue(vm, value)
+}
+
+func goStringFromLua(value *C.struct_lua_value) string {
+	union := (**C.char)(unsafe.Pointer(&(value.data)))
+	length := (*C.size_t)(unsafe.Pointer(&value.dataArg))
+	return C.GoStringN(*union, C.int(*length))
+}
+
 func buildGoValue(vm *LuaState, value *C.struct_lua_value) interface{} {
 	if value == nil {
 		return nil
@@ -141,13 +305,27 @@ func buildGoValue(vm *LuaState, value *C.struct_lua_value) interface{} {
 	switch value.valueType {
 	case C.LUA_TNUMBER:
 		union := (*C.double)(unsafe.Pointer(&value.data))
-		return float64(*union)
+		number := float64(*union)
+		if vm.int64Numbers && number == math.Trunc(number) && number >= -(1<<63) && number < (1<<63) {
+			return int64(number)
+		}
+		return number
+	case C.LUA_TINT64:
+		union := (*C.int64_t)(unsafe.Pointer(&value.data))
+		return int64(*union)
+	case C.LUA_TUINT64:
+		union := (*C.uint64_t)(unsafe.Pointer(&value.data))
+		return uint64(*union)
 	case C.LUA_TBOOLEAN:
 		union := (*C._Bool)(unsafe.Pointer(&value.data))
 		return bool(*union == (C._Bool)(true))
 	case C.LUA_TSTRING:
-		union := (**C.char)(unsafe.Pointer(&(value.data)))
-		return C.GoString(*union)
+		if vm.stringsAsBytes {
+			union := (*unsafe.Pointer)(unsafe.Pointer(&(value.data)))
+			length := (*C.size_t)(unsafe.Pointer(&value.dataArg))
+			return C.GoBytes(*union, C.int(*length))
+		}
+		return goStringFromLua(value)
 	case C.LUA_TTABLE:
 		value.temporary = C._Bool(false)
 		return &LocalLuaTable{
@@ -168,6 +346,24 @@ func buildGoValue(vm *LuaState, value *C.struct_lua_value) interface{} {
 			}
 		}
 
+		fallthrough
+	case C.LUA_TUSERDATA:
+		userDataType := (*C.int)(unsafe.Pointer(&value.dataArg))
+		if value.valueType == C.LUA_TUSERDATA && *userDataType == C.META_GOERROR {
+			//Go errors come back as themselves, the lua-side handle will be released by the caller
+			handle := C.get_userdata_handle(vm._l, value)
+			if goErr, ok := pointer.Restore(handle).(error); ok {
+				return goErr
+			}
+		}
+		if value.valueType == C.LUA_TUSERDATA && (*userDataType == C.META_GOPROXY || *userDataType >= C.META_GOTYPE_BASE) {
+			//Proxied values and registered types come back as the original go value
+			handle := C.get_userdata_handle(vm._l, value)
+			if proxied := pointer.Restore(handle); proxied != nil {
+				return proxied
+			}
+		}
+
 		fallthrough
 	default:
 		value.temporary = C._Bool(false)